@@ -0,0 +1,126 @@
+package guard
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	// acmeObtainTimeout bounds one issuance, which keeps running after
+	// the handshake that started it is gone.
+	acmeObtainTimeout = 2 * time.Minute
+	// acmeLockTTL outlives an issuance, so the lock can't expire and let
+	// another node start while this one is still obtaining.
+	acmeLockTTL = acmeObtainTimeout + 30*time.Second
+	// acmeLockSuffix is appended to the record key to name the lock
+	// taken in Redis while a node obtains its certificate.
+	acmeLockSuffix = ":acme_lock"
+)
+
+// errACMELocked is returned when another node is already obtaining the
+// certificate.
+var errACMELocked = errors.New("another node is obtaining the certificate")
+
+// acmeUnlock deletes the lock only while it still holds this node's token,
+// so a lock that expired and was taken by another node is left alone.
+var acmeUnlock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// acmeIssuer obtains certificates through certmagic for SNIs whose record
+// has no certificate. Challenges are answered by Caddy's own HTTP and
+// TLS-ALPN challenge handling, which certmagic solvers share in process.
+type acmeIssuer struct {
+	ctx    context.Context
+	config *certmagic.Config
+	issuer *certmagic.ACMEIssuer
+	cache  *certmagic.Cache
+	logger *zap.SugaredLogger
+}
+
+// newACMEIssuer sets up an issuer keeping its account and certificates in
+// storage. An empty ca uses certmagic's default, Let's Encrypt.
+func newACMEIssuer(ctx context.Context, storage certmagic.Storage, ca, email string, logger *zap.Logger) *acmeIssuer {
+	var config *certmagic.Config
+	cache := certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) {
+			return config, nil
+		},
+		Logger: logger,
+	})
+	config = certmagic.New(cache, certmagic.Config{Storage: storage, Logger: logger})
+	issuer := certmagic.NewACMEIssuer(config, certmagic.ACMEIssuer{
+		CA:     ca,
+		Email:  email,
+		Agreed: true,
+		Logger: logger,
+	})
+	config.Issuers = []certmagic.Issuer{issuer}
+
+	return &acmeIssuer{ctx: ctx, config: config, issuer: issuer, cache: cache, logger: logger.Sugar()}
+}
+
+// obtain issues a certificate for name, or loads the one certmagic already
+// keeps in storage, and returns its chain and key as PEM. Only the node
+// holding lockKey in client issues, so others fail with errACMELocked and
+// pick the certificate up from Redis once it is written back.
+func (a *acmeIssuer) obtain(client redis.UniversalClient, lockKey, name string) (certPEM, keyPEM []byte, err error) {
+	ctx, cancel := context.WithTimeout(a.ctx, acmeObtainTimeout)
+	defer cancel()
+
+	// the hostname tells operators who holds the lock, the random part
+	// tells this attempt from any other
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, nil, err
+	}
+	owner, _ := os.Hostname()
+	owner += ":" + hex.EncodeToString(token)
+
+	locked, err := client.SetNX(ctx, lockKey, owner, acmeLockTTL).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !locked {
+		return nil, nil, errACMELocked
+	}
+	defer func() {
+		if err := acmeUnlock.Run(context.Background(), client, []string{lockKey}, owner).Err(); err != nil {
+			a.logger.Warnf("Releasing the ACME lock for %s: %v", name, err)
+		}
+	}()
+
+	a.logger.Infof("Obtaining certificate for %s", name)
+	if err := a.config.ObtainCertSync(ctx, name); err != nil {
+		return nil, nil, err
+	}
+
+	issuerKey := a.issuer.IssuerKey()
+	if certPEM, err = a.config.Storage.Load(ctx, certmagic.StorageKeys.SiteCert(issuerKey, name)); err != nil {
+		return nil, nil, fmt.Errorf("loading issued certificate: %v", err)
+	}
+	if keyPEM, err = a.config.Storage.Load(ctx, certmagic.StorageKeys.SitePrivateKey(issuerKey, name)); err != nil {
+		return nil, nil, fmt.Errorf("loading issued key: %v", err)
+	}
+
+	return certPEM, keyPEM, nil
+}
+
+// stop ends certmagic's background maintenance.
+func (a *acmeIssuer) stop() {
+	if a != nil {
+		a.cache.Stop()
+	}
+}
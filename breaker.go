@@ -0,0 +1,107 @@
+package guard
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultBreakerCooldown is the default breaker_cooldown.
+const defaultBreakerCooldown = 10 * time.Second
+
+// errBreakerOpen is returned instead of reading Redis while the circuit
+// breaker is open.
+var errBreakerOpen = errors.New("redis circuit breaker is open")
+
+// circuitBreaker stops Redis lookups for a cooldown after a run of
+// connection failures, so an outage fails requests and handshakes at once
+// instead of each waiting for its own timeout. A nil breaker is always
+// closed.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	// openUntil is when the next probe may go through, zero while closed.
+	openUntil time.Time
+	logger    *zap.SugaredLogger
+}
+
+// newCircuitBreaker returns nil, a breaker that never opens, when
+// threshold is not positive.
+func newCircuitBreaker(threshold int, cooldown time.Duration, logger *zap.SugaredLogger) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, logger: logger}
+}
+
+// allow reports whether a lookup may go to Redis. While open, one lookup
+// per cooldown is let through as a probe.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// a probe that never reports back, e.g. canceled, allows the next
+	// one a cooldown later
+	b.openUntil = now.Add(b.cooldown)
+
+	return true
+}
+
+// record counts the result of a lookup allowed through. Only connection
+// failures count, not missing keys, error replies or canceled requests.
+// A success closes the breaker.
+func (b *circuitBreaker) record(err error) {
+	if b == nil || isCanceled(err) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !isConnectionError(err) {
+		if !b.openUntil.IsZero() {
+			b.logger.Info("Redis answered the probe, closing circuit breaker")
+		}
+		b.failures, b.openUntil = 0, time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.failures < b.threshold {
+		return
+	}
+	if b.openUntil.IsZero() {
+		b.logger.Warnf("Opening circuit breaker for %s after %d Redis failures: %v", b.cooldown, b.failures, err)
+	}
+	b.openUntil = time.Now().Add(b.cooldown)
+}
+
+// isOpen reports whether lookups are currently being short-circuited.
+func (b *circuitBreaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero()
+}
@@ -0,0 +1,243 @@
+package guard
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// defaultCacheSize bounds a cache when no size is configured.
+const defaultCacheSize = 10000
+
+// ttlCache is a size-bounded LRU cache whose entries expire after a fixed
+// TTL. It is safe for concurrent use.
+type ttlCache[V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type cacheEntry[V any] struct {
+	key     string
+	value   V
+	stored  time.Time
+	expires time.Time
+}
+
+// newTTLCache returns nil, a disabled cache, when ttl is not positive.
+func newTTLCache[V any](ttl time.Duration, size int) *ttlCache[V] {
+	if ttl <= 0 {
+		return nil
+	}
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+
+	return &ttlCache[V]{
+		ttl:     ttl,
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the unexpired value for key.
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	var zero V
+	if c == nil {
+		return zero, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := elem.Value.(*cacheEntry[V])
+	if time.Now().After(entry.expires) {
+		// kept for getStale until replaced or evicted
+		return zero, false
+	}
+	c.order.MoveToFront(elem)
+
+	return entry.value, true
+}
+
+// getStale returns the value for key even if it has expired.
+func (c *ttlCache[V]) getStale(key string) (V, bool) {
+	var zero V
+	if c == nil {
+		return zero, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+
+	return elem.Value.(*cacheEntry[V]).value, true
+}
+
+// put stores value for the cache's TTL, evicting the least recently used
+// entry when full.
+func (c *ttlCache[V]) put(key string, value V) {
+	if c == nil {
+		return
+	}
+
+	c.putTTL(key, value, c.ttl)
+}
+
+// putTTL stores value for ttl instead of the cache's TTL, e.g. one set per
+// record.
+func (c *ttlCache[V]) putTTL(key string, value V, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	expires := now.Add(ttl)
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry[V])
+		entry.value, entry.stored, entry.expires = value, now, expires
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	if c.order.Len() >= c.size {
+		c.remove(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry[V]{key: key, value: value, stored: now, expires: expires})
+}
+
+// delete drops key from the cache.
+func (c *ttlCache[V]) delete(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// deleteFunc drops every key for which match returns true.
+func (c *ttlCache[V]) deleteFunc(match func(key string) bool) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if match(key) {
+			c.remove(elem)
+		}
+	}
+}
+
+// len returns the number of entries, including expired ones not yet
+// evicted.
+func (c *ttlCache[V]) len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// clear drops every entry.
+func (c *ttlCache[V]) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// cachedEntry describes one entry for the admin API.
+type cachedEntry struct {
+	Key     string    `json:"key"`
+	Stored  time.Time `json:"stored"`
+	Age     string    `json:"age"`
+	Expires time.Time `json:"expires"`
+	Expired bool      `json:"expired"`
+	// Routing records: their tokens, several with token_source list or
+	// set, and the target each routes to.
+	Tokens  []string `json:"tokens,omitempty"`
+	Targets []string `json:"targets,omitempty"`
+	// Certificates: the cert field and expiry of each.
+	Certs []cachedCert `json:"certs,omitempty"`
+}
+
+// cachedCert describes one cached certificate for the admin API.
+type cachedCert struct {
+	Field    string    `json:"field"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// snapshot lists the entries, most recently used first, with the details
+// of each value added by describe, if not nil.
+func (c *ttlCache[V]) snapshot(describe func(value V, entry *cachedEntry)) []cachedEntry {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	entries := make([]cachedEntry, 0, c.order.Len())
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*cacheEntry[V])
+		described := cachedEntry{
+			Key:     entry.key,
+			Stored:  entry.stored,
+			Age:     now.Sub(entry.stored).Round(time.Second).String(),
+			Expires: entry.expires,
+			Expired: now.After(entry.expires),
+		}
+		if describe != nil {
+			describe(entry.value, &described)
+		}
+		entries = append(entries, described)
+	}
+
+	return entries
+}
+
+// describedCache lists a cache's entries with the details of their
+// values, for the admin API.
+type describedCache[V any] struct {
+	*ttlCache[V]
+	describe func(value V, entry *cachedEntry)
+}
+
+func (c describedCache[V]) snapshot() []cachedEntry {
+	return c.ttlCache.snapshot(c.describe)
+}
+
+func (c *ttlCache[V]) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry[V]).key)
+}
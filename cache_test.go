@@ -0,0 +1,68 @@
+package guard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCacheExpiry(t *testing.T) {
+	c := newTTLCache[string](20*time.Millisecond, 0)
+	c.put("a", "1")
+	c.putTTL("b", "2", time.Hour)
+
+	if v, ok := c.get("a"); !ok || v != "1" {
+		t.Fatalf("get(a) = %q, %v before expiry, want 1", v, ok)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	if _, ok := c.get("a"); ok {
+		t.Error("get(a) found an expired entry")
+	}
+	if v, ok := c.getStale("a"); !ok || v != "1" {
+		t.Errorf("getStale(a) = %q, %v, want the expired entry", v, ok)
+	}
+	if v, ok := c.get("b"); !ok || v != "2" {
+		t.Errorf("get(b) = %q, %v, want its own TTL to apply", v, ok)
+	}
+
+	c.put("a", "3")
+	if v, ok := c.get("a"); !ok || v != "3" {
+		t.Errorf("get(a) = %q, %v after replacing it, want 3", v, ok)
+	}
+	c.delete("a")
+	if _, ok := c.getStale("a"); ok {
+		t.Error("getStale(a) found a deleted entry")
+	}
+}
+
+func TestTTLCacheEviction(t *testing.T) {
+	c := newTTLCache[string](time.Hour, 2)
+	c.put("a", "1")
+	c.put("b", "2")
+	c.get("a")
+	c.put("c", "3")
+
+	if _, ok := c.getStale("b"); ok {
+		t.Error("least recently used entry b not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("entry %s evicted", key)
+		}
+	}
+	if c.len() != 2 {
+		t.Errorf("len() = %d, want 2", c.len())
+	}
+}
+
+func TestTTLCacheDisabled(t *testing.T) {
+	c := newTTLCache[string](0, 10)
+	if c != nil {
+		t.Fatal("newTTLCache() with no TTL returned a cache")
+	}
+
+	c.put("a", "1")
+	if _, ok := c.get("a"); ok {
+		t.Error("disabled cache stored an entry")
+	}
+}
@@ -0,0 +1,157 @@
+package guard
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/rand"
+	"time"
+)
+
+// certCandidate is a certificate parsed from one of the configured cert fields.
+type certCandidate struct {
+	field string
+	cert  tls.Certificate
+}
+
+func (c certCandidate) notAfter() time.Time {
+	return c.cert.Leaf.NotAfter
+}
+
+// validAt reports whether now is within the certificate's validity period.
+func (c certCandidate) validAt(now time.Time) bool {
+	return !now.Before(c.cert.Leaf.NotBefore) && now.Before(c.notAfter())
+}
+
+// newCertCandidate parses the leaf so expiry can be compared.
+func newCertCandidate(field string, cert tls.Certificate) (certCandidate, error) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return certCandidate{}, err
+	}
+	cert.Leaf = leaf
+
+	return certCandidate{field: field, cert: cert}, nil
+}
+
+// selectCert picks the longest-lived currently valid candidate, keeping
+// the configured field order on ties. When none is valid the longest-lived
+// one is returned and valid is false.
+func selectCert(candidates []certCandidate, now time.Time) (selected certCandidate, valid bool) {
+	for i, c := range candidates {
+		unexpired := c.validAt(now)
+		switch {
+		case i == 0:
+		case unexpired && !valid:
+		case unexpired == valid && c.notAfter().After(selected.notAfter()):
+		default:
+			continue
+		}
+		selected, valid = c, unexpired
+	}
+
+	return selected, valid
+}
+
+// selectWeightedCert picks among the unexpired candidates at random in
+// proportion to their field's weight, so a new certificate can take a
+// share of handshakes during rotation. Fields without a weight are never
+// picked. ok is false when no unexpired candidate has a positive weight.
+func selectWeightedCert(candidates []certCandidate, weights map[string]int, now time.Time) (selected certCandidate, ok bool) {
+	total := 0
+	for _, c := range candidates {
+		if c.validAt(now) {
+			total += weights[c.field]
+		}
+	}
+	if total <= 0 {
+		return certCandidate{}, false
+	}
+
+	n := rand.Intn(total)
+	for _, c := range candidates {
+		if !c.validAt(now) {
+			continue
+		}
+		if n -= weights[c.field]; n < 0 {
+			return c, true
+		}
+	}
+
+	return certCandidate{}, false
+}
+
+// tlsVersions maps the version names accepted by cert_by_version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// maxSupportedVersion returns the highest TLS version offered by the client.
+func maxSupportedVersion(hello *tls.ClientHelloInfo) uint16 {
+	var max uint16
+	for _, v := range hello.SupportedVersions {
+		if v > max {
+			max = v
+		}
+	}
+
+	return max
+}
+
+// certFieldForVersion returns the cert field mapped to the client's
+// highest supported TLS version, if any.
+func certFieldForVersion(byVersion map[string]string, hello *tls.ClientHelloInfo) (string, bool) {
+	max := maxSupportedVersion(hello)
+	for name, field := range byVersion {
+		if tlsVersions[name] == max {
+			return field, true
+		}
+	}
+
+	return "", false
+}
+
+// certAlgorithms lists the key algorithms accepted by cert_by_algorithm,
+// most preferred first.
+var certAlgorithms = []string{"ecdsa", "ed25519", "rsa"}
+
+// algorithmFields returns the cert fields of byAlgorithm in preference
+// order.
+func algorithmFields(byAlgorithm map[string]string) []string {
+	var fields []string
+	for _, name := range certAlgorithms {
+		if field, ok := byAlgorithm[name]; ok {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// selectCertForClient returns the first currently valid candidate, in
+// preference order, whose key the client can use.
+func selectCertForClient(candidates []certCandidate, hello *tls.ClientHelloInfo, now time.Time) (certCandidate, bool) {
+	for _, c := range candidates {
+		if c.validAt(now) && hello.SupportsCertificate(&c.cert) == nil {
+			return c, true
+		}
+	}
+
+	return certCandidate{}, false
+}
+
+func knownCertAlgorithm(name string) bool {
+	return containsString(certAlgorithms, name)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
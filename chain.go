@@ -0,0 +1,60 @@
+package guard
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// parseChain returns the DER certificates of an intermediate chain held
+// as PEM, or as concatenated DER with format der.
+func parseChain(data []byte, format string) ([][]byte, error) {
+	if format == formatDER {
+		return splitDER(data)
+	}
+
+	var chain [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block type in chain: %s", block.Type)
+		}
+		chain = append(chain, block.Bytes)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificates in chain")
+	}
+
+	return chain, nil
+}
+
+// appendChain adds chain to cert and checks that the result runs leaf
+// first, each certificate issued by the next one.
+func appendChain(cert *tls.Certificate, chain [][]byte) error {
+	certs := make([]*x509.Certificate, 0, len(cert.Certificate)+len(chain))
+	for _, der := range append(cert.Certificate[:len(cert.Certificate):len(cert.Certificate)], chain...) {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("parsing chain: %v", err)
+		}
+		certs = append(certs, c)
+	}
+
+	for i := 1; i < len(certs); i++ {
+		if bytes.Equal(certs[i].Raw, certs[i-1].Raw) {
+			return fmt.Errorf("chain repeats certificate %q", certs[i].Subject)
+		}
+		if !bytes.Equal(certs[i-1].RawIssuer, certs[i].RawSubject) {
+			return fmt.Errorf("chain out of order: %q is not issued by %q", certs[i-1].Subject, certs[i].Subject)
+		}
+	}
+
+	cert.Certificate = append(cert.Certificate, chain...)
+	return nil
+}
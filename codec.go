@@ -0,0 +1,188 @@
+package guard
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// defaultGzipLimit is the most the gzip codec decompresses a value to,
+// unless its argument sets another number of bytes, so a small value
+// can't inflate without bound.
+const defaultGzipLimit = 1 << 20
+
+// errGzipTooLarge is returned by gunzip for values over its limit.
+var errGzipTooLarge = errors.New("decompressed value exceeds the limit")
+
+// ValueCodec transforms a raw value read from Redis into the form
+// expected by the module, e.g. decoding base64 or decompressing gzip.
+type ValueCodec interface {
+	Decode([]byte) ([]byte, error)
+}
+
+// CodecConstructor builds a codec from the optional argument following
+// its name, e.g. "json:cert" passes "cert" to the json codec.
+type CodecConstructor func(arg string) (ValueCodec, error)
+
+var codecs = make(map[string]CodecConstructor)
+
+func init() {
+	RegisterCodec("identity", func(string) (ValueCodec, error) { return identityCodec{}, nil })
+	RegisterCodec("base64", func(string) (ValueCodec, error) { return base64Codec{}, nil })
+	RegisterCodec("gzip", func(arg string) (ValueCodec, error) {
+		if arg == "" {
+			return gzipCodec{limit: defaultGzipLimit}, nil
+		}
+		limit, err := strconv.Atoi(arg)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("gzip codec: invalid limit %q, e.g. gzip:1048576", arg)
+		}
+		return gzipCodec{limit: limit}, nil
+	})
+	RegisterCodec("json", func(arg string) (ValueCodec, error) {
+		if arg == "" {
+			return nil, fmt.Errorf("json codec requires a field name, e.g. json:cert")
+		}
+		return jsonCodec{field: arg}, nil
+	})
+}
+
+// RegisterCodec makes a codec available by name to the `codecs` directive.
+// It panics if the name is already registered.
+func RegisterCodec(name string, newCodec CodecConstructor) {
+	if _, ok := codecs[name]; ok {
+		panic(fmt.Sprintf("codec already registered: %s", name))
+	}
+	codecs[name] = newCodec
+}
+
+// codecChain runs its codecs in order, feeding each output into the next.
+type codecChain []ValueCodec
+
+// newCodecChain builds a chain from specs of the form "name" or "name:arg".
+func newCodecChain(specs []string) (codecChain, error) {
+	chain := make(codecChain, 0, len(specs))
+	for _, spec := range specs {
+		name, arg, _ := strings.Cut(spec, ":")
+		newCodec, ok := codecs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown codec: %s", name)
+		}
+		codec, err := newCodec(arg)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, codec)
+	}
+
+	return chain, nil
+}
+
+func (c codecChain) Decode(value []byte) ([]byte, error) {
+	var err error
+	for _, codec := range c {
+		value, err = codec.Decode(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return value, nil
+}
+
+type identityCodec struct{}
+
+func (identityCodec) Decode(value []byte) ([]byte, error) {
+	return value, nil
+}
+
+type base64Codec struct{}
+
+func (base64Codec) Decode(value []byte) ([]byte, error) {
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(value)))
+	n, err := base64.StdEncoding.Decode(decoded, bytes.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("base64 codec: %v", err)
+	}
+
+	return decoded[:n], nil
+}
+
+// gzipCodec decompresses values of up to limit bytes decompressed.
+type gzipCodec struct {
+	limit int
+}
+
+func (c gzipCodec) Decode(value []byte) ([]byte, error) {
+	decoded, err := gunzip(value, c.limit)
+	if err != nil {
+		return nil, fmt.Errorf("gzip codec: %v", err)
+	}
+
+	return decoded, nil
+}
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzip reports whether value looks like gzip data. PEM and DER values
+// never start with its magic bytes.
+func isGzip(value []byte) bool {
+	return bytes.HasPrefix(value, gzipMagic)
+}
+
+// gunzip decompresses value, failing with errGzipTooLarge once the output
+// exceeds limit bytes, without inflating the rest. A negative limit
+// decompresses everything.
+func gunzip(value []byte, limit int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	if limit < 0 {
+		return io.ReadAll(zr)
+	}
+
+	// one byte over the limit tells an oversized value from one that fits
+	decoded, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > limit {
+		return nil, fmt.Errorf("%w of %d bytes", errGzipTooLarge, limit)
+	}
+
+	return decoded, nil
+}
+
+// jsonCodec extracts a single string field from a JSON object.
+type jsonCodec struct {
+	field string
+}
+
+func (c jsonCodec) Decode(value []byte) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(value, &obj); err != nil {
+		return nil, fmt.Errorf("json codec: %v", err)
+	}
+
+	raw, ok := obj[c.field]
+	if !ok {
+		return nil, fmt.Errorf("json codec: field %s not found", c.field)
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("json codec: field %s: %v", c.field, err)
+	}
+
+	return []byte(s), nil
+}
@@ -0,0 +1,60 @@
+package guard
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+// gzipped returns n zero bytes, gzip compressed.
+func gzipped(t *testing.T, n int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestGzipCodecLimit(t *testing.T) {
+	tests := []struct {
+		spec    string
+		size    int
+		wantErr bool
+	}{
+		{spec: "gzip", size: 1024},
+		{spec: "gzip", size: defaultGzipLimit},
+		{spec: "gzip", size: defaultGzipLimit + 1, wantErr: true},
+		{spec: "gzip", size: 8 << 20, wantErr: true},
+		{spec: "gzip:100", size: 100},
+		{spec: "gzip:100", size: 101, wantErr: true},
+		{spec: "gzip:4194304", size: 2 << 20},
+	}
+
+	for _, tt := range tests {
+		chain, err := newCodecChain([]string{tt.spec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := chain.Decode(gzipped(t, tt.size))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Decode() of %d bytes error = %v, want error %v", tt.spec, tt.size, err, tt.wantErr)
+			continue
+		}
+		if err == nil && len(decoded) != tt.size {
+			t.Errorf("%s: Decode() = %d bytes, want %d", tt.spec, len(decoded), tt.size)
+		}
+	}
+
+	for _, spec := range []string{"gzip:0", "gzip:-1", "gzip:1MB"} {
+		if _, err := newCodecChain([]string{spec}); err == nil {
+			t.Errorf("newCodecChain(%q) succeeded, want invalid limit", spec)
+		}
+	}
+}
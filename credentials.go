@@ -0,0 +1,82 @@
+package guard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// credentialsFetchTimeout bounds how long a (re)connect waits for an
+// endpoint credentials source.
+const credentialsFetchTimeout = 5 * time.Second
+
+// redisCredentials is the JSON document read from a credentials source.
+type redisCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// newCredentialsProvider returns a go-redis CredentialsProvider which
+// reads credentials from source, a file path or http(s) URL, on every
+// (re)connect so rotated secrets are picked up without a reload. If the
+// source can't be read the static username and password are used.
+func newCredentialsProvider(source, username, password string, logger *zap.SugaredLogger) func() (string, string) {
+	return func() (string, string) {
+		creds, err := readCredentials(source)
+		if err != nil {
+			logger.Warnf("Reading redis credentials from %s, using static credentials: %v", source, err)
+			return username, password
+		}
+
+		return creds.Username, creds.Password
+	}
+}
+
+func readCredentials(source string) (redisCredentials, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = fetchCredentials(source)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return redisCredentials{}, err
+	}
+
+	var creds redisCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return redisCredentials{}, fmt.Errorf("decoding credentials: %v", err)
+	}
+
+	return creds, nil
+}
+
+func fetchCredentials(url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialsFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
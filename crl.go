@@ -0,0 +1,159 @@
+package guard
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// crlFetchTimeout bounds a single CRL download or Redis read.
+const crlFetchTimeout = 10 * time.Second
+
+// maxCRLSize bounds a CRL read, so a misbehaving server can't exhaust
+// memory. Large public CAs publish CRLs of a few megabytes.
+const maxCRLSize = 32 << 20
+
+var errRevokedCert = errors.New("certificate revoked")
+
+// crlChecker keeps the revoked certificates of a CRL read from an http(s)
+// URL or a Redis key, refreshed in the background, by issuer and serial,
+// as serials are only unique per issuer. The CRL signature is not
+// verified, so the source must be trusted.
+type crlChecker struct {
+	source  string
+	client  redis.UniversalClient
+	logger  *zap.SugaredLogger
+	mu      sync.RWMutex
+	revoked map[string]struct{}
+}
+
+// newCRLChecker loads the CRL once, failing if that doesn't work, then
+// refreshes it every interval until ctx is done. Refresh failures keep
+// the previous list.
+func newCRLChecker(ctx context.Context, source string, interval time.Duration, client redis.UniversalClient, logger *zap.SugaredLogger) (*crlChecker, error) {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	c := &crlChecker{source: source, client: client, logger: logger}
+	if err := c.refresh(ctx); err != nil {
+		return nil, fmt.Errorf("loading crl from %s: %v", source, err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.refresh(ctx); err != nil {
+					c.logger.Warnf("Refreshing crl from %s, keeping previous list: %v", c.source, err)
+				}
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+// isRevoked reports whether the certificate's issuer and serial are listed.
+func (c *crlChecker) isRevoked(cert *x509.Certificate) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.revoked[revocationKey(cert.RawIssuer, cert.SerialNumber)]
+	return ok
+}
+
+// revocationKey identifies a certificate by the DER encoded name of its
+// issuer and its serial. Serials never contain the "/" separating them.
+func revocationKey(issuer []byte, serial *big.Int) string {
+	return serial.String() + "/" + string(issuer)
+}
+
+func (c *crlChecker) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, crlFetchTimeout)
+	defer cancel()
+
+	data, err := c.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	revoked, err := parseCRL(data)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.revoked = revoked
+	c.mu.Unlock()
+
+	return nil
+}
+
+// parseCRL returns the revocationKey of every entry of a PEM or DER CRL.
+func parseCRL(data []byte) (map[string]struct{}, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := make(map[string]struct{}, len(crl.RevokedCertificates))
+	for _, entry := range crl.RevokedCertificates {
+		revoked[revocationKey(crl.RawIssuer, entry.SerialNumber)] = struct{}{}
+	}
+
+	return revoked, nil
+}
+
+func (c *crlChecker) fetch(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(c.source, "http://") && !strings.HasPrefix(c.source, "https://") {
+		data, err := c.client.Get(ctx, c.source).Bytes()
+		if err == nil && len(data) > maxCRLSize {
+			return nil, fmt.Errorf("crl larger than %d bytes", maxCRLSize)
+		}
+		return data, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCRLSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxCRLSize {
+		return nil, fmt.Errorf("crl larger than %d bytes", maxCRLSize)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,133 @@
+package guard
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          []byte(name),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testCA{cert: cert, key: key}
+}
+
+// issue returns a leaf certificate with serial signed by ca.
+func (ca testCA) issue(t *testing.T, serial int64) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// crl returns a PEM CRL of ca revoking serials.
+func (ca testCA) crl(t *testing.T, serials ...int64) []byte {
+	t.Helper()
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		template.RevokedCertificates = append(template.RevokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestCRLCheckerIsRevoked(t *testing.T) {
+	issuer, other := newTestCA(t, "Issuer CA"), newTestCA(t, "Other CA")
+
+	revoked, err := parseCRL(issuer.crl(t, 42, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &crlChecker{revoked: revoked}
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want bool
+	}{
+		{name: "listed serial of the issuer", cert: issuer.issue(t, 42), want: true},
+		{name: "other listed serial of the issuer", cert: issuer.issue(t, 7), want: true},
+		{name: "unlisted serial of the issuer", cert: issuer.issue(t, 43), want: false},
+		{name: "listed serial of another issuer", cert: other.issue(t, 42), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.isRevoked(tt.cert); got != tt.want {
+				t.Errorf("isRevoked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCRLRejectsGarbage(t *testing.T) {
+	if _, err := parseCRL([]byte("not a crl")); err == nil {
+		t.Error("parseCRL() succeeded on garbage")
+	}
+}
@@ -0,0 +1,202 @@
+package guard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// debugStats is a snapshot of one module instance's internals.
+type debugStats struct {
+	Module  string `json:"module"`
+	Prefix  string `json:"prefix"`
+	Lookups int    `json:"lookups_in_flight"`
+	// Keys with a deduplicated lookup in flight, see dedupe_lookups.
+	DedupedKeys  int              `json:"deduped_keys_in_flight"`
+	CacheEntries int              `json:"cache_entries"`
+	Pool         *redis.PoolStats `json:"pool"`
+	// Result of the last Redis ping.
+	RedisUp      bool      `json:"redis_up"`
+	RedisChecked time.Time `json:"redis_checked"`
+	RedisError   string    `json:"redis_error,omitempty"`
+	// Whether breaker_threshold currently short-circuits lookups.
+	BreakerOpen bool `json:"breaker_open"`
+}
+
+// setHealth fills in the Redis health fields from h.
+func (s *debugStats) setHealth(h *redisHealth) {
+	up, checked, err := h.status()
+	s.RedisUp, s.RedisChecked = up, checked
+	if err != nil {
+		s.RedisError = err.Error()
+	}
+}
+
+// debugSources holds the instances provisioned with debug_stats, keyed
+// by module pointer, until their Cleanup.
+var debugSources = struct {
+	mu      sync.Mutex
+	sources map[any]func() debugStats
+}{sources: make(map[any]func() debugStats)}
+
+func registerDebugSource(key any, stats func() debugStats) {
+	debugSources.mu.Lock()
+	defer debugSources.mu.Unlock()
+	debugSources.sources[key] = stats
+}
+
+func unregisterDebugSource(key any) {
+	debugSources.mu.Lock()
+	defer debugSources.mu.Unlock()
+	delete(debugSources.sources, key)
+}
+
+// inspectableCache is the part of ttlCache used by the admin API.
+type inspectableCache interface {
+	snapshot() []cachedEntry
+	delete(key string)
+	clear()
+}
+
+// cacheSource is a module instance's cache as listed by the admin API.
+type cacheSource struct {
+	Module  string        `json:"module"`
+	Prefix  string        `json:"prefix"`
+	Entries []cachedEntry `json:"entries"`
+	cache   inspectableCache
+}
+
+// cacheSources holds the instances provisioned with a cache, keyed by
+// module pointer, until their Cleanup.
+var cacheSources = struct {
+	mu      sync.Mutex
+	sources map[any]cacheSource
+}{sources: make(map[any]cacheSource)}
+
+func registerCacheSource(key any, module, prefix string, cache inspectableCache) {
+	cacheSources.mu.Lock()
+	defer cacheSources.mu.Unlock()
+	cacheSources.sources[key] = cacheSource{Module: module, Prefix: prefix, cache: cache}
+}
+
+func unregisterCacheSource(key any) {
+	cacheSources.mu.Lock()
+	defer cacheSources.mu.Unlock()
+	delete(cacheSources.sources, key)
+}
+
+// adminAPI serves /dynamic-routing/debug and /dynamic-routing/cache on
+// the Caddy admin endpoint, so they are subject to the admin API's own
+// access controls.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.dynamic_routing",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/dynamic-routing/debug",
+			Handler: caddy.AdminHandlerFunc(a.handleDebug),
+		},
+		{
+			Pattern: "/dynamic-routing/cache",
+			Handler: caddy.AdminHandlerFunc(a.handleCache),
+		},
+	}
+}
+
+func (adminAPI) handleDebug(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	debugSources.mu.Lock()
+	stats := make([]debugStats, 0, len(debugSources.sources))
+	for _, source := range debugSources.sources {
+		stats = append(stats, source())
+	}
+	debugSources.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Module != stats[j].Module {
+			return stats[i].Module < stats[j].Module
+		}
+		return stats[i].Prefix < stats[j].Prefix
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(stats)
+}
+
+// handleCache lists cached entries on GET. DELETE drops the entry named
+// by the key query parameter, or every entry without one; the module
+// parameter ("routing" or "tls") limits either to one module.
+func (adminAPI) handleCache(w http.ResponseWriter, r *http.Request) error {
+	module := r.URL.Query().Get("module")
+
+	cacheSources.mu.Lock()
+	sources := make([]cacheSource, 0, len(cacheSources.sources))
+	for _, source := range cacheSources.sources {
+		if module == "" || source.Module == module {
+			sources = append(sources, source)
+		}
+	}
+	cacheSources.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		for i := range sources {
+			sources[i].Entries = sources[i].cache.snapshot()
+		}
+		sort.Slice(sources, func(i, j int) bool {
+			if sources[i].Module != sources[j].Module {
+				return sources[i].Module < sources[j].Module
+			}
+			return sources[i].Prefix < sources[j].Prefix
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(sources)
+
+	case http.MethodDelete:
+		key := r.URL.Query().Get("key")
+		for _, source := range sources {
+			if key == "" {
+				source.cache.clear()
+			} else {
+				source.cache.delete(key)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+}
+
+// Interface guards
+var _ caddy.AdminRouter = (*adminAPI)(nil)
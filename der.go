@@ -0,0 +1,91 @@
+package guard
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// Certificate formats for Format.
+const (
+	formatPEM = "pem"
+	formatDER = "der"
+)
+
+// tlsCertFromDER builds a certificate from raw DER. certs holds the leaf
+// and any intermediates back to back; when key is nil the private key is
+// expected as the last element of certs.
+func tlsCertFromDER(certs, key []byte) (tls.Certificate, error) {
+	elems, err := splitDER(certs)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if key == nil {
+		if len(elems) < 2 {
+			return tls.Certificate{}, fmt.Errorf("no private key found")
+		}
+		key, elems = elems[len(elems)-1], elems[:len(elems)-1]
+	}
+
+	var cert tls.Certificate
+	for _, der := range elems {
+		if _, err := x509.ParseCertificate(der); err != nil {
+			return tls.Certificate{}, fmt.Errorf("parsing certificate: %v", err)
+		}
+		cert.Certificate = append(cert.Certificate, der)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+
+	cert.PrivateKey, err = parseDERPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PrivateKey.(crypto.Signer).Public()) {
+		return tls.Certificate{}, fmt.Errorf("private key does not match certificate")
+	}
+
+	return cert, nil
+}
+
+// parseDERPrivateKey tries the PKCS #8, PKCS #1 and SEC 1 encodings in
+// turn, like crypto/tls does for PEM keys.
+func parseDERPrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if _, ok := key.(crypto.Signer); !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	return nil, errors.New("unknown private key format")
+}
+
+// splitDER splits concatenated DER values.
+func splitDER(data []byte) ([][]byte, error) {
+	var elems [][]byte
+	for len(data) > 0 {
+		var raw asn1.RawValue
+		rest, err := asn1.Unmarshal(data, &raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing DER: %v", err)
+		}
+		elems = append(elems, raw.FullBytes)
+		data = rest
+	}
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("no DER data")
+	}
+
+	return elems, nil
+}
@@ -0,0 +1,75 @@
+package guard
+
+import (
+	"sync"
+	"time"
+)
+
+// drainTimeout bounds how long Cleanup waits for in-flight Redis
+// operations before releasing the client.
+const drainTimeout = 5 * time.Second
+
+// inFlightOps counts running Redis operations, so Cleanup can let them
+// finish on a config reload instead of closing the client under them. A
+// nil inFlightOps counts nothing.
+type inFlightOps struct {
+	mu sync.Mutex
+	n  int
+	// idle is closed when n drops to zero while drain waits.
+	idle chan struct{}
+}
+
+// start counts an operation until the returned func is called.
+func (o *inFlightOps) start() (done func()) {
+	if o == nil {
+		return func() {}
+	}
+
+	o.mu.Lock()
+	o.n++
+	o.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			o.n--
+			if o.n == 0 && o.idle != nil {
+				close(o.idle)
+				o.idle = nil
+			}
+		})
+	}
+}
+
+// drain waits up to timeout for the running operations to finish and
+// returns how many are still running.
+func (o *inFlightOps) drain(timeout time.Duration) int {
+	if o == nil {
+		return 0
+	}
+
+	o.mu.Lock()
+	if o.n == 0 {
+		o.mu.Unlock()
+		return 0
+	}
+	if o.idle == nil {
+		o.idle = make(chan struct{})
+	}
+	idle := o.idle
+	o.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return 0
+	case <-timer.C:
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.n
+}
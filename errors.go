@@ -0,0 +1,45 @@
+package guard
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of lookup failure, for errors.Is on errors returned by
+// GetCertificate and ServeHTTP.
+var (
+	// ErrCertNotFound means the SNI has no certificate record.
+	ErrCertNotFound = errors.New("no certificate")
+	// ErrHostNotFound means the host has no routing record, with
+	// require_token.
+	ErrHostNotFound = errors.New("no routing record")
+	// ErrRedisUnavailable means Redis could not be reached or failed.
+	ErrRedisUnavailable = errors.New("redis unavailable")
+	// ErrInvalidRecord means the record exists but its data can't be used.
+	ErrInvalidRecord = errors.New("invalid record")
+)
+
+// LookupError describes a failed lookup of Name, the SNI or host. It
+// matches its Kind with errors.Is and unwraps to the underlying error.
+type LookupError struct {
+	Kind error
+	Name string
+	Err  error
+}
+
+func newLookupError(kind error, name string, err error) *LookupError {
+	return &LookupError{Kind: kind, Name: name, Err: err}
+}
+
+func (e *LookupError) Error() string {
+	return fmt.Sprintf("%v for %s: %v", e.Kind, e.Name, e.Err)
+}
+
+// Is reports whether target is e's Kind.
+func (e *LookupError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *LookupError) Unwrap() error {
+	return e.Err
+}
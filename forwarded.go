@@ -0,0 +1,71 @@
+package guard
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Header formats accepted by forwarded_headers.
+const (
+	forwardedLegacy  = "legacy"
+	forwardedRFC7239 = "rfc7239"
+)
+
+func validateForwardedFormat(format string) error {
+	switch format {
+	case "", forwardedLegacy, forwardedRFC7239:
+		return nil
+	default:
+		return fmt.Errorf("unknown forwarded_headers format: %s", format)
+	}
+}
+
+// recordForwarded records the original host and proto of a rewritten
+// request, appending to any values set by earlier hops.
+func (m Middleware) recordForwarded(r *http.Request) {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	switch m.ForwardedHeaders {
+	case forwardedLegacy:
+		appendHeader(r.Header, "X-Forwarded-Host", r.Host)
+		appendHeader(r.Header, "X-Forwarded-Proto", proto)
+	case forwardedRFC7239:
+		// the host may carry a port, which is not a valid token
+		appendHeader(r.Header, "Forwarded", "host="+quoteString(r.Host)+";proto="+proto)
+	}
+
+	if m.Via != "" {
+		appendHeader(r.Header, "Via", fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, m.Via))
+	}
+}
+
+// quoteString returns s as an RFC 7230 quoted-string, escaping only " and
+// \ with a backslash. Unlike %q it leaves other bytes as they are rather
+// than writing Go escapes, which HTTP parsers would take literally.
+func quoteString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+// appendHeader adds value as a new list element of the header, keeping
+// a single header line.
+func appendHeader(h http.Header, name, value string) {
+	if prior := h.Values(name); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(name, value)
+}
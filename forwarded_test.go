@@ -0,0 +1,24 @@
+package guard
+
+import "testing"
+
+func TestQuoteString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: `""`},
+		{in: "example.com:8443", want: `"example.com:8443"`},
+		{in: "[::1]:8080", want: `"[::1]:8080"`},
+		{in: `a"b`, want: `"a\"b"`},
+		{in: `a\b`, want: `"a\\b"`},
+		{in: "bücher.example", want: "\"bücher.example\""},
+		{in: "a\tb", want: "\"a\tb\""},
+	}
+
+	for _, tt := range tests {
+		if got := quoteString(tt.in); got != tt.want {
+			t.Errorf("quoteString(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
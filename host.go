@@ -0,0 +1,179 @@
+package guard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Values of key_hash.
+const (
+	keyHashNone   = "none"
+	keyHashSHA256 = "sha256"
+)
+
+// maxDNSNameLength is the longest textual DNS name, used as the default
+// max_host_length.
+const maxDNSNameLength = 253
+
+var (
+	errHostTooLong   = errors.New("host too long")
+	errInvalidTarget = errors.New("invalid target host")
+)
+
+// hostnameLabel matches one DNS label; underscores are allowed since
+// they are common in service names.
+var hostnameLabel = regexp.MustCompile(`^[a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9_])?$`)
+
+// hostLengthPolicy guards against oversized Redis keys built from crafted
+// Host headers or SNI values.
+type hostLengthPolicy struct {
+	max      int
+	truncate bool
+}
+
+func newHostLengthPolicy(max int, policy string) (hostLengthPolicy, error) {
+	if max <= 0 {
+		max = maxDNSNameLength
+	}
+
+	switch policy {
+	case "", "reject":
+		return hostLengthPolicy{max: max}, nil
+	case "truncate":
+		return hostLengthPolicy{max: max, truncate: true}, nil
+	default:
+		return hostLengthPolicy{}, fmt.Errorf("unknown long_host policy: %s", policy)
+	}
+}
+
+// apply returns host, truncated if allowed, or errHostTooLong.
+func (p hostLengthPolicy) apply(host string) (string, error) {
+	if len(host) <= p.max {
+		return host, nil
+	}
+	if !p.truncate {
+		return "", fmt.Errorf("%w: %d bytes", errHostTooLong, len(host))
+	}
+
+	return host[:p.max], nil
+}
+
+// checkKeyHash rejects unknown key_hash values.
+func checkKeyHash(keyHash string) error {
+	switch keyHash {
+	case "", keyHashNone, keyHashSHA256:
+		return nil
+	default:
+		return fmt.Errorf("unknown key_hash: %s", keyHash)
+	}
+}
+
+// hashKeyName returns name as it appears in Redis keys: unchanged, or
+// with key_hash sha256 the lowercase hex SHA-256 of its bytes, so keys
+// don't hold plaintext host names.
+func hashKeyName(keyHash, name string) string {
+	if keyHash != keyHashSHA256 {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeHost lowercases a Host header and strips its port, if any.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(host)
+}
+
+// sameHost reports whether a and b name the same host, ignoring case,
+// ports and a trailing dot.
+func sameHost(a, b string) bool {
+	return strings.TrimSuffix(normalizeHost(a), ".") == strings.TrimSuffix(normalizeHost(b), ".")
+}
+
+// normalizeTarget lowercases host, drops a trailing dot and checks that
+// it is a valid hostname or IP address, with an optional port.
+func normalizeTarget(host string) (string, error) {
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		name, port = h, p
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	if !validHostname(name) && net.ParseIP(name) == nil {
+		return "", fmt.Errorf("%w: %q", errInvalidTarget, host)
+	}
+	if port == "" {
+		return name, nil
+	}
+
+	return net.JoinHostPort(name, port), nil
+}
+
+func validHostname(name string) bool {
+	if name == "" || len(name) > maxDNSNameLength {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !hostnameLabel.MatchString(label) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isIPHost reports whether a Host header value is an IP literal, with or
+// without a port.
+func isIPHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return net.ParseIP(strings.Trim(host, "[]")) != nil
+}
+
+// wildcardName replaces the leftmost label of name with "*". ok is false
+// when that would leave fewer than two labels, e.g. for an apex domain,
+// or when name is already a wildcard.
+func wildcardName(name string) (wildcard string, ok bool) {
+	if strings.HasPrefix(name, "*.") {
+		return "", false
+	}
+	_, parent, found := strings.Cut(name, ".")
+	if !found || !strings.Contains(parent, ".") {
+		return "", false
+	}
+
+	return "*." + parent, true
+}
+
+// Encodings accepted by sni_encoding.
+const (
+	sniEncodingUnicode  = "unicode"
+	sniEncodingPunycode = "punycode"
+)
+
+// encodeSNI converts name to Unicode or punycode with the IDNA lookup
+// profile. An empty encoding returns name unchanged.
+func encodeSNI(name, encoding string) (string, error) {
+	switch encoding {
+	case sniEncodingUnicode:
+		return idna.Lookup.ToUnicode(name)
+	case sniEncodingPunycode:
+		return idna.Lookup.ToASCII(name)
+	default:
+		return name, nil
+	}
+}
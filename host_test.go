@@ -0,0 +1,46 @@
+package guard
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTarget(t *testing.T) {
+	tests := []struct {
+		host    string
+		want    string
+		wantErr bool
+	}{
+		{host: "backend.internal", want: "backend.internal"},
+		{host: "Backend.Internal.", want: "backend.internal"},
+		{host: "backend.internal:8080", want: "backend.internal:8080"},
+		{host: "svc_a.internal", want: "svc_a.internal"},
+		{host: "10.0.0.1:80", want: "10.0.0.1:80"},
+		{host: "[::1]:443", want: "[::1]:443"},
+		{host: "::1", want: "::1"},
+		{host: "", wantErr: true},
+		{host: ".internal", wantErr: true},
+		{host: "bad host.internal", wantErr: true},
+		{host: "a..internal", wantErr: true},
+		{host: "-a.internal", wantErr: true},
+		{host: "a-.internal", wantErr: true},
+		{host: "exa$mple.internal", wantErr: true},
+		{host: "backend.internal/path", wantErr: true},
+		{host: "back\nend.internal", wantErr: true},
+		{host: strings.Repeat("a", 64) + ".internal", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeTarget(tt.host)
+		if tt.wantErr {
+			if !errors.Is(err, errInvalidTarget) {
+				t.Errorf("normalizeTarget(%q) = %q, %v, want errInvalidTarget", tt.host, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeTarget(%q) = %q, %v, want %q", tt.host, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package guard
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errTooManyLookups is returned when no lookup slot frees up in time.
+var errTooManyLookups = errors.New("too many concurrent redis lookups")
+
+// lookupLimiter bounds the number of concurrent Redis lookups. A nil
+// limiter imposes no limit.
+type lookupLimiter struct {
+	slots  chan struct{}
+	wait   time.Duration
+	module string
+}
+
+func newLookupLimiter(module string, max int, wait time.Duration) *lookupLimiter {
+	ensureMetrics()
+	dynamicRoutingMetrics.lookupLimit.WithLabelValues(module).Set(float64(max))
+	if max <= 0 {
+		return nil
+	}
+
+	return &lookupLimiter{
+		slots:  make(chan struct{}, max),
+		wait:   wait,
+		module: module,
+	}
+}
+
+// acquire takes a slot, queueing for up to the configured wait. Every
+// successful acquire must be paired with a release.
+func (l *lookupLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		dynamicRoutingMetrics.lookupsInFlight.WithLabelValues(l.module).Inc()
+		return nil
+	default:
+	}
+
+	if l.wait > 0 {
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+
+		select {
+		case l.slots <- struct{}{}:
+			dynamicRoutingMetrics.lookupsInFlight.WithLabelValues(l.module).Inc()
+			return nil
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	dynamicRoutingMetrics.lookupsRejected.WithLabelValues(l.module).Inc()
+	return errTooManyLookups
+}
+
+func (l *lookupLimiter) release() {
+	if l == nil {
+		return
+	}
+
+	<-l.slots
+	dynamicRoutingMetrics.lookupsInFlight.WithLabelValues(l.module).Dec()
+}
+
+// inFlight returns the number of slots taken.
+func (l *lookupLimiter) inFlight() int {
+	if l == nil {
+		return 0
+	}
+
+	return len(l.slots)
+}
@@ -0,0 +1,252 @@
+package guard
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/redis/go-redis/v9"
+)
+
+// loadCertsTimeout bounds the Redis writes of one redis-load-certs run.
+const loadCertsTimeout = time.Minute
+
+// wildcardFilePrefix stands for "*." in certificate file names, as
+// written by mkcert, since "*" is awkward in file names.
+const wildcardFilePrefix = "_wildcard."
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "redis-load-certs",
+		Func:  cmdLoadCerts,
+		Usage: "[--url <redis url>] [--prefix <prefix>] [--cert-key <field>] [--key-key <field>] [--key-hash none|sha256] (--sni <name> --cert <file> [--key <file>] | --dir <dir>)",
+		Short: "Writes certificates from disk to Redis for get_certificate redis",
+		Long: `
+Writes certificates and their keys from disk to Redis, in the schema
+read by get_certificate redis: the hash <prefix>:<sni> holds the
+certificate chain and private key as one PEM bundle in the field
+--cert-key, or the key in its own field --key-key when set.
+
+Load a single certificate with --sni, --cert and, unless the cert file
+already holds the key, --key. Or load every certificate in --dir: each
+<name>.crt or <name>.pem file is stored under the SNI <name>, with its
+key from <name>.key or <name>-key.pem if present. A name starting with
+"_wildcard." is stored as "*.", e.g. _wildcard.example.com.pem as
+*.example.com.
+
+With --key-hash sha256, the SNI in the key is hashed as by the key_hash
+directive.
+
+Each pair is checked to match before anything is written.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("redis-load-certs", flag.ExitOnError)
+			fs.String("url", "redis://127.0.0.1:6379/0", "Redis URL")
+			fs.String("prefix", "s", "Key prefix, as in the prefix directive")
+			fs.String("cert-key", "cert", "Field for the certificate, as in the certKey directive")
+			fs.String("key-key", "", "Field for the private key, as in the keyKey directive")
+			fs.String("key-hash", "none", "How the SNI is put into the key, as in the key_hash directive")
+			fs.String("sni", "", "Server name to store a single certificate for")
+			fs.String("cert", "", "Certificate chain file, or PEM bundle with the key")
+			fs.String("key", "", "Private key file")
+			fs.String("dir", "", "Directory of certificates to load")
+			return fs
+		}(),
+	})
+}
+
+// StoreCertificate checks that certPEM and keyPEM form a key pair and
+// writes them to the hash at key, in the schema get_certificate redis
+// reads: both as one PEM bundle in certField, or the key in keyField when
+// set. keyPEM may be empty if certPEM is a bundle with the key.
+func StoreCertificate(ctx context.Context, client redis.UniversalClient, key, certField, keyField string, certPEM, keyPEM []byte) error {
+	bundle := certPEM
+	if len(keyPEM) > 0 {
+		bundle = joinPEM(certPEM, keyPEM)
+	}
+	if _, err := tlsCertFromCertAndKeyPEMBundle(bundle); err != nil {
+		return err
+	}
+
+	values := []interface{}{certField, bundle}
+	if keyField != "" {
+		chain, keyOnly, err := splitPEMBundle(bundle)
+		if err != nil {
+			return err
+		}
+		values = []interface{}{certField, chain, keyField, keyOnly}
+	}
+
+	return client.HSet(ctx, key, values...).Err()
+}
+
+// joinPEM concatenates PEM documents, making sure each starts on its own
+// line.
+func joinPEM(docs ...[]byte) []byte {
+	var joined []byte
+	for _, doc := range docs {
+		joined = append(joined, doc...)
+		if len(doc) > 0 && doc[len(doc)-1] != '\n' {
+			joined = append(joined, '\n')
+		}
+	}
+
+	return joined
+}
+
+// splitPEMBundle separates the certificates of a PEM bundle from its
+// private key, both re-encoded as PEM.
+func splitPEMBundle(bundle []byte) (chain, key []byte, err error) {
+	cert, err := tlsCertFromCertAndKeyPEMBundle(bundle)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var chainBuf bytes.Buffer
+	for _, der := range cert.Certificate {
+		if err := encodePEM(&chainBuf, "CERTIFICATE", der); err != nil {
+			return nil, nil, err
+		}
+	}
+	key, err = privateKeyPEM(cert)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return chainBuf.Bytes(), key, nil
+}
+
+// certFile is a certificate to load and the SNI to store it under.
+type certFile struct {
+	sni, cert, key string
+}
+
+// findCertFiles lists the certificates in dir, see the redis-load-certs
+// help for the naming rules.
+func findCertFiles(dir string) ([]certFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []certFile
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || ext != ".crt" && ext != ".pem" || strings.HasSuffix(name, "-key.pem") {
+			continue
+		}
+
+		base := strings.TrimSuffix(name, ext)
+		file := certFile{sni: base, cert: filepath.Join(dir, name)}
+		if strings.HasPrefix(base, wildcardFilePrefix) {
+			file.sni = "*." + strings.TrimPrefix(base, wildcardFilePrefix)
+		}
+		for _, keyName := range []string{base + ".key", base + "-key.pem"} {
+			if _, err := os.Stat(filepath.Join(dir, keyName)); err == nil {
+				file.key = filepath.Join(dir, keyName)
+				break
+			}
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+func cmdLoadCerts(fl caddycmd.Flags) (int, error) {
+	var files []certFile
+	switch dir := fl.String("dir"); {
+	case dir != "" && fl.String("sni") != "":
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--dir and --sni can't be used together")
+	case dir != "":
+		found, err := findCertFiles(dir)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		if len(found) == 0 {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("no certificates found in %s", dir)
+		}
+		files = found
+	case fl.String("sni") != "" && fl.String("cert") != "":
+		files = []certFile{{sni: fl.String("sni"), cert: fl.String("cert"), key: fl.String("key")}}
+	default:
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("either --dir or --sni and --cert are required")
+	}
+
+	if err := checkKeyHash(fl.String("key-hash")); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	opts, err := redis.ParseURL(fl.String("url"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid --url: %v", err)
+	}
+	client := redis.NewClient(opts)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), loadCertsTimeout)
+	defer cancel()
+
+	failed := 0
+	for _, file := range files {
+		key := fmt.Sprintf("%s:%s", fl.String("prefix"), hashKeyName(fl.String("key-hash"), file.sni))
+		if err := loadCertFile(ctx, client, key, fl.String("cert-key"), fl.String("key-key"), file); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file.cert, err)
+			failed++
+			continue
+		}
+		fmt.Printf("Stored %s in %s\n", file.cert, key)
+	}
+	if failed > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%d of %d certificates failed", failed, len(files))
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+// loadCertFile reads the files of file and stores them at key.
+func loadCertFile(ctx context.Context, client redis.UniversalClient, key, certField, keyField string, file certFile) error {
+	certPEM, err := os.ReadFile(file.cert)
+	if err != nil {
+		return err
+	}
+	var keyPEM []byte
+	if file.key != "" {
+		if keyPEM, err = os.ReadFile(file.key); err != nil {
+			return err
+		}
+	}
+
+	return StoreCertificate(ctx, client, key, certField, keyField, certPEM, keyPEM)
+}
+
+// privateKeyPEM encodes the private key of cert as PKCS #8 PEM.
+func privateKeyPEM(cert tls.Certificate) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("encoding private key: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := encodePEM(&buf, "PRIVATE KEY", der); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encodePEM writes der to w as a PEM block of type blockType.
+func encodePEM(w io.Writer, blockType string, der []byte) error {
+	return pem.Encode(w, &pem.Block{Type: blockType, Bytes: der})
+}
@@ -0,0 +1,22 @@
+package guard
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// newDecisionLogger returns the logger used for per-lookup decision logs.
+// When sample is above 1 only the first entry per message each second and
+// then 1 in sample are written, using zap's sampler which keys on the
+// message, so decision logs keep their details in fields.
+func newDecisionLogger(logger *zap.Logger, sample int) *zap.SugaredLogger {
+	if sample <= 1 {
+		return logger.Sugar()
+	}
+
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewSamplerWithOptions(core, time.Second, 1, sample)
+	})).Sugar()
+}
@@ -0,0 +1,235 @@
+package guard
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Module labels used by the metrics below.
+const (
+	metricsModuleRouting = "routing"
+	metricsModuleTLS     = "tls"
+)
+
+var dynamicRoutingMetrics = struct {
+	init            sync.Once
+	lookupLimit     *prometheus.GaugeVec
+	lookupsInFlight *prometheus.GaugeVec
+	lookupsRejected *prometheus.CounterVec
+	dryRunRewrites  prometheus.Counter
+	tenantsSeen     prometheus.Gauge
+	certSelections  *prometheus.CounterVec
+	requests        *prometheus.CounterVec
+	hostRequests    *prometheus.CounterVec
+	redisDuration   *prometheus.HistogramVec
+	cacheLookups    *prometheus.CounterVec
+	errors          *prometheus.CounterVec
+}{}
+
+// Error types counted by the errors_total metric.
+const (
+	errorTypeHost      = "host"
+	errorTypeRedis     = "redis"
+	errorTypeParse     = "parse"
+	errorTypeEmpty     = "empty"
+	errorTypeRevoked   = "revoked"
+	errorTypeExpired   = "expired"
+	errorTypeTarget    = "target"
+	errorTypeSignature = "signature"
+)
+
+func initDynamicRoutingMetrics() {
+	const ns, sub = "caddy", "dynamic_routing"
+
+	moduleLabels := []string{"module"}
+	dynamicRoutingMetrics.lookupLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "lookup_limit",
+		Help:      "Maximum number of concurrent Redis lookups, 0 when unlimited.",
+	}, moduleLabels)
+	dynamicRoutingMetrics.lookupsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "lookups_in_flight",
+		Help:      "Number of Redis lookups currently in flight.",
+	}, moduleLabels)
+	dynamicRoutingMetrics.lookupsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "lookups_rejected_total",
+		Help:      "Counter of Redis lookups rejected by the concurrency limit.",
+	}, moduleLabels)
+	dynamicRoutingMetrics.dryRunRewrites = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "dry_run_rewrites_total",
+		Help:      "Counter of host rewrites, redirects and denials skipped because of dry_run.",
+	})
+	dynamicRoutingMetrics.tenantsSeen = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "tenants_seen",
+		Help:      "Estimated number of distinct hosts routed in the current tenant_window.",
+	})
+	dynamicRoutingMetrics.certSelections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "weighted_cert_selections_total",
+		Help:      "Counter of certificates served by cert_weights, by cert field.",
+	}, []string{"field"})
+	dynamicRoutingMetrics.requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "requests_total",
+		Help:      "Counter of routed requests and certificate lookups.",
+	}, moduleLabels)
+	dynamicRoutingMetrics.hostRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "host_requests_total",
+		Help:      "Counter of routed requests and certificate lookups by host bucket, see metrics_hosts.",
+	}, []string{"module", "host"})
+	dynamicRoutingMetrics.redisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "redis_duration_seconds",
+		Help:      "Histogram of Redis lookup round trips.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, moduleLabels)
+	dynamicRoutingMetrics.cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "cache_lookups_total",
+		Help:      "Counter of in-memory cache lookups by result (hit or miss).",
+	}, []string{"module", "result"})
+	dynamicRoutingMetrics.errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "errors_total",
+		Help:      "Counter of failed lookups by type. Canceled lookups are not counted.",
+	}, []string{"module", "type"})
+}
+
+// ensureMetrics registers the collectors once per process, since modules
+// are provisioned again on every config reload.
+func ensureMetrics() {
+	dynamicRoutingMetrics.init.Do(initDynamicRoutingMetrics)
+}
+
+// observeRedis records the duration of a Redis round trip started at start.
+func observeRedis(module string, start time.Time) {
+	dynamicRoutingMetrics.redisDuration.WithLabelValues(module).Observe(time.Since(start).Seconds())
+}
+
+// countError counts a failed lookup of the given type.
+func countError(module, kind string) {
+	dynamicRoutingMetrics.errors.WithLabelValues(module, kind).Inc()
+}
+
+// countCacheLookup counts a cache hit or miss.
+func countCacheLookup(module string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	dynamicRoutingMetrics.cacheLookups.WithLabelValues(module, result).Inc()
+}
+
+// Strategies of metrics_hosts, labeling hosts that aren't tracked.
+const (
+	hostLabelsTLD     = "tld"
+	hostLabelsTracked = "tracked"
+)
+
+const (
+	// hostLabelOther is the label of hosts not tracked by name, or past
+	// maxHostLabels.
+	hostLabelOther = "other"
+	// maxHostLabels bounds the distinct host labels per module, whatever
+	// names clients send.
+	maxHostLabels = 100
+)
+
+// hostLabeler buckets hosts into a bounded set of host_requests_total
+// labels: tracked hosts by name, others by TLD or as "other".
+type hostLabeler struct {
+	module   string
+	strategy string
+	tracked  map[string]struct{}
+	mu       sync.Mutex
+	seen     map[string]struct{}
+}
+
+// newHostLabeler returns nil, counting nothing, when strategy is empty.
+// Tracked names may be wildcards such as "*.example.com".
+func newHostLabeler(module, strategy string, tracked []string) (*hostLabeler, error) {
+	switch strategy {
+	case "":
+		return nil, nil
+	case hostLabelsTLD:
+	case hostLabelsTracked:
+		if len(tracked) == 0 {
+			return nil, fmt.Errorf("metrics_hosts tracked needs at least one host")
+		}
+	default:
+		return nil, fmt.Errorf("unknown metrics_hosts strategy: %s", strategy)
+	}
+
+	l := &hostLabeler{
+		module:   module,
+		strategy: strategy,
+		tracked:  make(map[string]struct{}, len(tracked)),
+		seen:     make(map[string]struct{}),
+	}
+	for _, name := range tracked {
+		l.tracked[strings.ToLower(name)] = struct{}{}
+	}
+
+	return l, nil
+}
+
+// count counts a request or handshake for host.
+func (l *hostLabeler) count(host string) {
+	if l == nil {
+		return
+	}
+	dynamicRoutingMetrics.hostRequests.WithLabelValues(l.module, l.label(host)).Inc()
+}
+
+// label returns the bucket of host, "other" once maxHostLabels distinct
+// labels have been handed out.
+func (l *hostLabeler) label(host string) string {
+	label := hostLabelOther
+	if l.isTracked(host) {
+		label = host
+	} else if wildcard, ok := wildcardName(host); ok && l.isTracked(wildcard) {
+		label = wildcard
+	} else if i := strings.LastIndexByte(host, '.'); l.strategy == hostLabelsTLD && i >= 0 && i < len(host)-1 && !isIPHost(host) {
+		label = host[i+1:]
+	}
+	if label == hostLabelOther {
+		return label
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[label]; !ok {
+		if len(l.seen) >= maxHostLabels {
+			return hostLabelOther
+		}
+		l.seen[label] = struct{}{}
+	}
+
+	return label
+}
+
+func (l *hostLabeler) isTracked(name string) bool {
+	_, ok := l.tracked[name]
+	return ok
+}
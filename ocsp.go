@@ -0,0 +1,175 @@
+package guard
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspFetchTimeout bounds a single OCSP responder request.
+	ocspFetchTimeout = 10 * time.Second
+	// ocspRetryInterval spaces out attempts for a failing responder.
+	ocspRetryInterval = 5 * time.Minute
+	// maxOCSPStaples bounds the staple cache.
+	maxOCSPStaples = 10000
+	// maxOCSPResponseSize bounds the body read from a responder.
+	maxOCSPResponseSize = 1 << 20
+)
+
+// ocspStaple is a cached OCSP response for one certificate.
+type ocspStaple struct {
+	der        []byte
+	thisUpdate time.Time
+	nextUpdate time.Time
+	// lastAttempt rate limits fetches while the responder fails.
+	lastAttempt time.Time
+	fetching    bool
+}
+
+// ocspStapler staples OCSP responses fetched from the responder in the
+// certificate's AIA extension. Fetches run in the background so
+// handshakes never wait on a responder; until the first response
+// arrives certificates are served without a staple.
+type ocspStapler struct {
+	ctx     context.Context
+	logger  *zap.SugaredLogger
+	mu      sync.Mutex
+	staples map[string]*ocspStaple
+}
+
+func newOCSPStapler(ctx context.Context, logger *zap.SugaredLogger) *ocspStapler {
+	return &ocspStapler{ctx: ctx, logger: logger, staples: make(map[string]*ocspStaple)}
+}
+
+// staple sets cert's OCSPStaple from the cache and starts a fetch when
+// there is no response yet or it is past half its validity.
+func (s *ocspStapler) staple(cert *tls.Certificate) {
+	leaf := cert.Leaf
+	if s == nil || leaf == nil || len(leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+		return
+	}
+
+	now := time.Now()
+	key := leaf.SerialNumber.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	staple, ok := s.staples[key]
+	if ok && staple.der != nil && now.Before(staple.nextUpdate) {
+		cert.OCSPStaple = staple.der
+	}
+
+	refreshAt := time.Time{}
+	if ok && staple.der != nil {
+		refreshAt = staple.thisUpdate.Add(staple.nextUpdate.Sub(staple.thisUpdate) / 2)
+	}
+	if ok && (staple.fetching || now.Before(refreshAt) || now.Sub(staple.lastAttempt) < ocspRetryInterval) {
+		return
+	}
+
+	if !ok {
+		if len(s.staples) >= maxOCSPStaples {
+			s.evictExpired(now)
+			if len(s.staples) >= maxOCSPStaples {
+				return
+			}
+		}
+		staple = new(ocspStaple)
+		s.staples[key] = staple
+	}
+	staple.fetching = true
+	staple.lastAttempt = now
+
+	go s.fetch(key, leaf, cert.Certificate[1])
+}
+
+func (s *ocspStapler) fetch(key string, leaf *x509.Certificate, issuerDER []byte) {
+	resp, der, err := s.request(leaf, issuerDER)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	staple, ok := s.staples[key]
+	if !ok {
+		return
+	}
+	staple.fetching = false
+	if err != nil {
+		s.logger.Warnf("Fetching OCSP staple for serial %s: %v", key, err)
+		return
+	}
+	if resp.Status != ocsp.Good {
+		s.logger.Warnf("OCSP responder reports serial %s as not good (status %d), not stapling", key, resp.Status)
+		staple.der = nil
+		return
+	}
+
+	staple.der, staple.thisUpdate, staple.nextUpdate = der, resp.ThisUpdate, resp.NextUpdate
+	if staple.nextUpdate.IsZero() {
+		// no next update means newer information is always available
+		staple.nextUpdate = staple.thisUpdate.Add(ocspRetryInterval)
+	}
+}
+
+func (s *ocspStapler) request(leaf *x509.Certificate, issuerDER []byte) (*ocsp.Response, []byte, error) {
+	issuer, err := x509.ParseCertificate(issuerDER)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing issuer: %v", err)
+	}
+
+	body, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, ocspFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status: %s", httpResp.Status)
+	}
+
+	der, err := io.ReadAll(io.LimitReader(httpResp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, der, nil
+}
+
+// evictExpired drops staples past their next update. s.mu must be held.
+func (s *ocspStapler) evictExpired(now time.Time) {
+	for key, staple := range s.staples {
+		if !staple.fetching && now.After(staple.nextUpdate) {
+			delete(s.staples, key)
+		}
+	}
+}
@@ -0,0 +1,974 @@
+package guard
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// selfTestTimeout bounds the sentinel lookup done by self_test in Provision.
+const selfTestTimeout = 5 * time.Second
+
+// redisHealthInterval is how often the Redis connection is checked.
+const redisHealthInterval = 10 * time.Second
+
+// Default Redis timeouts. The write timeout defaults to the read timeout.
+const (
+	defaultDialTimeout = 5 * time.Second
+	defaultReadTimeout = 3 * time.Second
+)
+
+// statusClientClosedRequest is the nginx-style status for requests whose
+// client went away, as also used by reverse_proxy.
+const statusClientClosedRequest = 499
+
+// isCanceled reports whether err comes from a canceled or expired context
+// rather than from Redis, e.g. because the client disconnected.
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// RedisConfig holds the Redis connection settings shared by both modules,
+// inlined in their JSON config and set by the Caddyfile directives of the
+// same names.
+type RedisConfig struct {
+	// Address of a single node, default 127.0.0.1:6379, or the path of a
+	// Unix socket instead.
+	Host   string `json:"host,omitempty"`
+	Port   string `json:"port,omitempty"`
+	Socket string `json:"socket,omitempty"`
+	// redis://, rediss:// or unix:// URL overriding the address, database,
+	// credentials and, for rediss://, TLS. A TLS block is kept, for client
+	// certificates.
+	URL      string `json:"url,omitempty"`
+	DB       int    `json:"db,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Connect over TLS, with default settings when empty.
+	TLS *RedisTLSConfig `json:"tls,omitempty"`
+	// Default 5s to dial and 3s to read; writes default to ReadTimeout.
+	DialTimeout  caddy.Duration `json:"dial_timeout,omitempty"`
+	ReadTimeout  caddy.Duration `json:"read_timeout,omitempty"`
+	WriteTimeout caddy.Duration `json:"write_timeout,omitempty"`
+	// Connection pool limits, go-redis defaults when 0.
+	PoolSize     int `json:"pool_size,omitempty"`
+	MinIdleConns int `json:"min_idle_conns,omitempty"`
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+	// Close connections idle for ConnMaxIdleTime, go-redis default 30m,
+	// or open for ConnMaxLifetime, by default never, before a NAT or
+	// load balancer silently drops them.
+	ConnMaxIdleTime caddy.Duration `json:"conn_max_idle_time,omitempty"`
+	ConnMaxLifetime caddy.Duration `json:"conn_max_lifetime,omitempty"`
+	// Retries of failed commands, default 3 and -1 for none, with a
+	// backoff growing from MinRetryBackoff to MaxRetryBackoff.
+	MaxRetries      int            `json:"max_retries,omitempty"`
+	MinRetryBackoff caddy.Duration `json:"min_retry_backoff,omitempty"`
+	MaxRetryBackoff caddy.Duration `json:"max_retry_backoff,omitempty"`
+	// Find the primary through Sentinel, or connect to a cluster through
+	// these seed nodes, instead of a single node.
+	Sentinel *RedisSentinelConfig `json:"sentinel,omitempty"`
+	Cluster  []string             `json:"cluster,omitempty"`
+	// Addresses of read replicas of a single node to spread lookups over,
+	// falling back to the primary when a replica fails. Writes always go
+	// to the primary.
+	ReadReplicas []string `json:"read_replicas,omitempty"`
+}
+
+// RedisTLSConfig configures a TLS connection to Redis, with PEM files for
+// the CA to trust and a client certificate.
+type RedisTLSConfig struct {
+	CA                 string `json:"ca,omitempty"`
+	Cert               string `json:"cert,omitempty"`
+	Key                string `json:"key,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// RedisSentinelConfig locates the primary through Redis Sentinel.
+type RedisSentinelConfig struct {
+	MasterName string   `json:"master_name"`
+	Addrs      []string `json:"addrs"`
+	Username   string   `json:"username,omitempty"`
+	Password   string   `json:"password,omitempty"`
+}
+
+// options builds the go-redis options and topology of c, with defaults.
+func (c RedisConfig) options() (redis.Options, redisTopology, error) {
+	var topology redisTopology
+	if c.Sentinel != nil {
+		if len(c.Cluster) > 0 {
+			return redis.Options{}, topology, fmt.Errorf("sentinel and cluster can't be used together")
+		}
+		if c.Sentinel.MasterName == "" || len(c.Sentinel.Addrs) == 0 {
+			return redis.Options{}, topology, fmt.Errorf("sentinel needs master_name and addrs")
+		}
+		topology = redisTopology{
+			masterName:       c.Sentinel.MasterName,
+			sentinelAddrs:    c.Sentinel.Addrs,
+			sentinelUsername: c.Sentinel.Username,
+			sentinelPassword: c.Sentinel.Password,
+		}
+	}
+	topology.clusterAddrs = c.Cluster
+
+	if c.Socket != "" && (c.Host != "" || c.Port != "") {
+		return redis.Options{}, topology, fmt.Errorf("socket can't be used with host or port")
+	}
+	if c.Socket != "" && (c.Sentinel != nil || len(c.Cluster) > 0) {
+		return redis.Options{}, topology, fmt.Errorf("socket can't be used with sentinel or cluster")
+	}
+	if len(c.ReadReplicas) > 0 && (c.Sentinel != nil || len(c.Cluster) > 0) {
+		return redis.Options{}, topology, fmt.Errorf("read_replicas can't be used with sentinel or cluster")
+	}
+	if c.MaxRetries < -1 || c.MaxRetries > maxRedisRetries {
+		return redis.Options{}, topology, fmt.Errorf("invalid max_retries, want -1 to %d: %d", maxRedisRetries, c.MaxRetries)
+	}
+	if c.ConnMaxIdleTime < 0 || c.ConnMaxLifetime < 0 {
+		return redis.Options{}, topology, fmt.Errorf("conn_max_idle_time and conn_max_lifetime can't be negative")
+	}
+	if c.MaxRetryBackoff != 0 && c.MaxRetryBackoff < c.MinRetryBackoff {
+		return redis.Options{}, topology, fmt.Errorf("max_retry_backoff is below min_retry_backoff")
+	}
+
+	host, port := c.Host, c.Port
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if port == "" {
+		port = "6379"
+	}
+	opts := redis.Options{
+		Network:         "tcp",
+		Addr:            net.JoinHostPort(host, port),
+		DB:              c.DB,
+		Username:        c.Username,
+		Password:        c.Password,
+		DialTimeout:     time.Duration(c.DialTimeout),
+		ReadTimeout:     time.Duration(c.ReadTimeout),
+		WriteTimeout:    time.Duration(c.WriteTimeout),
+		PoolSize:        c.PoolSize,
+		MinIdleConns:    c.MinIdleConns,
+		MaxIdleConns:    c.MaxIdleConns,
+		ConnMaxIdleTime: time.Duration(c.ConnMaxIdleTime),
+		ConnMaxLifetime: time.Duration(c.ConnMaxLifetime),
+		MaxRetries:      c.MaxRetries,
+		MinRetryBackoff: time.Duration(c.MinRetryBackoff),
+		MaxRetryBackoff: time.Duration(c.MaxRetryBackoff),
+	}
+	if c.Socket != "" {
+		opts.Network, opts.Addr = "unix", c.Socket
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = defaultDialTimeout
+	}
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = defaultReadTimeout
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = opts.ReadTimeout
+	}
+	if opts.MaxRetryBackoff == 0 {
+		opts.MaxRetryBackoff = opts.MinRetryBackoff
+	}
+
+	if c.TLS != nil {
+		config, err := c.TLS.config()
+		if err != nil {
+			return redis.Options{}, topology, err
+		}
+		opts.TLSConfig = config
+	}
+	if c.URL != "" {
+		if err := applyRedisURL(c.URL, &opts); err != nil {
+			return redis.Options{}, topology, err
+		}
+	}
+
+	return opts, topology, nil
+}
+
+// fallbackOptions builds the options of c as a fallback_redis, which is
+// a single node.
+func (c RedisConfig) fallbackOptions() (*redis.Options, error) {
+	if c.Sentinel != nil || len(c.Cluster) > 0 || len(c.ReadReplicas) > 0 {
+		return nil, fmt.Errorf("fallback_redis can't use sentinel, cluster or read_replicas")
+	}
+	if c.Host == "" && c.Socket == "" && c.URL == "" {
+		return nil, fmt.Errorf("fallback_redis needs host, socket or url")
+	}
+
+	opts, _, err := c.options()
+	if err != nil {
+		return nil, fmt.Errorf("fallback_redis: %v", err)
+	}
+
+	return &opts, nil
+}
+
+// config loads the files of c into the client config for Redis.
+func (c RedisTLSConfig) config() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca %s", c.CA)
+		}
+	}
+
+	if (c.Cert == "") != (c.Key == "") {
+		return nil, fmt.Errorf("tls cert and key must be set together")
+	}
+	if c.Cert != "" {
+		pair, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	return config, nil
+}
+
+// unmarshalCaddyfileDirective parses the connection directive at d into
+// c. handled is false for directives that aren't about the connection.
+func (c *RedisConfig) unmarshalCaddyfileDirective(d *caddyfile.Dispenser) (handled bool, err error) {
+	switch name := d.Val(); name {
+	case "host":
+		if d.NextArg() {
+			c.Host = d.Val()
+		}
+	case "port":
+		if d.NextArg() {
+			c.Port = d.Val()
+		}
+	case "url":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		if _, err := redis.ParseURL(d.Val()); err != nil {
+			return true, d.Errf("invalid url: %v", err)
+		}
+		c.URL = d.Val()
+	case "socket":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.Socket = d.Val()
+	case "db":
+		if d.NextArg() {
+			db, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return true, d.ArgErr()
+			}
+			c.DB = db
+		}
+	case "username":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.Username = d.Val()
+	case "password":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.Password = d.Val()
+	case "tls":
+		c.TLS, err = unmarshalRedisTLS(d)
+	case "pool_size", "min_idle_conns", "max_idle_conns":
+		n, err := unmarshalRedisPoolSize(d)
+		if err != nil {
+			return true, err
+		}
+		switch name {
+		case "pool_size":
+			c.PoolSize = n
+		case "min_idle_conns":
+			c.MinIdleConns = n
+		default:
+			c.MaxIdleConns = n
+		}
+	case "max_retries":
+		c.MaxRetries, err = unmarshalRedisRetries(d)
+	case "retry_backoff":
+		lo, hi, err := unmarshalRedisRetryBackoff(d)
+		if err != nil {
+			return true, err
+		}
+		c.MinRetryBackoff, c.MaxRetryBackoff = caddy.Duration(lo), caddy.Duration(hi)
+	case "dial_timeout", "read_timeout", "write_timeout", "conn_max_idle_time", "conn_max_lifetime":
+		timeout, err := unmarshalRedisTimeout(d)
+		if err != nil {
+			return true, err
+		}
+		switch name {
+		case "dial_timeout":
+			c.DialTimeout = caddy.Duration(timeout)
+		case "read_timeout":
+			c.ReadTimeout = caddy.Duration(timeout)
+		case "write_timeout":
+			c.WriteTimeout = caddy.Duration(timeout)
+		case "conn_max_idle_time":
+			c.ConnMaxIdleTime = caddy.Duration(timeout)
+		default:
+			c.ConnMaxLifetime = caddy.Duration(timeout)
+		}
+	case "sentinel":
+		err = unmarshalRedisSentinel(d, c)
+	case "cluster":
+		err = unmarshalRedisCluster(d, c)
+	case "read_replicas":
+		c.ReadReplicas = d.RemainingArgs()
+		if len(c.ReadReplicas) == 0 {
+			return true, d.ArgErr()
+		}
+	default:
+		return false, nil
+	}
+
+	return true, err
+}
+
+// unmarshalRedisTLS parses the tls block shared by both modules:
+//
+//	tls {
+//		ca <file>
+//		cert <file>
+//		key <file>
+//		insecure_skip_verify
+//	}
+func unmarshalRedisTLS(d *caddyfile.Dispenser) (*RedisTLSConfig, error) {
+	config := new(RedisTLSConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "ca":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			config.CA = d.Val()
+		case "cert":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			config.Cert = d.Val()
+		case "key":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			config.Key = d.Val()
+		case "insecure_skip_verify":
+			config.InsecureSkipVerify = true
+		default:
+			return nil, d.Errf("Unknown tls field: %s", d.Val())
+		}
+	}
+
+	if (config.Cert == "") != (config.Key == "") {
+		return nil, d.Err("tls cert and key must be set together")
+	}
+
+	return config, nil
+}
+
+// unmarshalRedisTimeout parses the duration argument of a *_timeout
+// directive, e.g. "2s" or "500ms".
+func unmarshalRedisTimeout(d *caddyfile.Dispenser) (time.Duration, error) {
+	name := d.Val()
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+
+	timeout, err := caddy.ParseDuration(d.Val())
+	if err != nil || timeout <= 0 {
+		return 0, d.Errf("invalid %s: %s", name, d.Val())
+	}
+
+	return timeout, nil
+}
+
+// unmarshalRedisPoolSize parses the positive integer argument of a
+// connection pool directive such as pool_size.
+func unmarshalRedisPoolSize(d *caddyfile.Dispenser) (int, error) {
+	name := d.Val()
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+
+	n, err := strconv.Atoi(d.Val())
+	if err != nil || n <= 0 {
+		return 0, d.Errf("invalid %s: %s", name, d.Val())
+	}
+
+	return n, nil
+}
+
+// maxRedisRetries bounds max_retries so retries can't amplify an outage.
+const maxRedisRetries = 10
+
+// unmarshalRedisRetries parses max_retries. 0 disables retries, which
+// go-redis spells -1.
+func unmarshalRedisRetries(d *caddyfile.Dispenser) (int, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+
+	n, err := strconv.Atoi(d.Val())
+	if err != nil || n < 0 || n > maxRedisRetries {
+		return 0, d.Errf("invalid max_retries, want 0 to %d: %s", maxRedisRetries, d.Val())
+	}
+	if n == 0 {
+		n = -1
+	}
+
+	return n, nil
+}
+
+// unmarshalRedisRetryBackoff parses retry_backoff <min> [<max>]. The
+// backoff between retries grows from min to max.
+func unmarshalRedisRetryBackoff(d *caddyfile.Dispenser) (minBackoff, maxBackoff time.Duration, err error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return 0, 0, d.ArgErr()
+	}
+
+	minBackoff, err = caddy.ParseDuration(args[0])
+	if err != nil || minBackoff <= 0 {
+		return 0, 0, d.Errf("invalid retry_backoff: %s", args[0])
+	}
+	maxBackoff = minBackoff
+	if len(args) == 2 {
+		maxBackoff, err = caddy.ParseDuration(args[1])
+		if err != nil || maxBackoff < minBackoff {
+			return 0, 0, d.Errf("invalid retry_backoff maximum: %s", args[1])
+		}
+	}
+
+	return minBackoff, maxBackoff, nil
+}
+
+// applyRedisURL overrides the address, database, credentials and, for
+// rediss://, TLS of opts with those of a redis://, rediss:// or unix://
+// URL. A TLS config already in opts is kept, for client certificates.
+func applyRedisURL(raw string, opts *redis.Options) error {
+	parsed, err := redis.ParseURL(raw)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+
+	opts.Network, opts.Addr, opts.DB = parsed.Network, parsed.Addr, parsed.DB
+	opts.Username, opts.Password = parsed.Username, parsed.Password
+	switch {
+	case parsed.TLSConfig == nil:
+	case opts.TLSConfig == nil:
+		opts.TLSConfig = parsed.TLSConfig
+	case opts.TLSConfig.ServerName == "":
+		opts.TLSConfig.ServerName = parsed.TLSConfig.ServerName
+	}
+
+	return nil
+}
+
+// validateRedisAddrs checks that the TCP addresses of the primary, the
+// sentinel or cluster nodes and the read replicas are host:port.
+func validateRedisAddrs(opts *redis.Options, topology redisTopology, replicas []string) error {
+	var addrs []string
+	if opts.Addr != "" && opts.Network != "unix" {
+		addrs = append(addrs, opts.Addr)
+	}
+	addrs = append(addrs, topology.sentinelAddrs...)
+	addrs = append(addrs, topology.clusterAddrs...)
+	addrs = append(addrs, replicas...)
+
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid redis address %q: %v", addr, err)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("invalid redis address %q: bad port", addr)
+		}
+		if host == "" {
+			return fmt.Errorf("invalid redis address %q: missing host", addr)
+		}
+	}
+
+	return nil
+}
+
+// unmarshalRedisFallback parses the fallback_redis block shared by both
+// modules, taking the single node directives of the main block. Unset
+// settings take the defaults, not those of the primary:
+//
+//	fallback_redis {
+//		host <host>
+//		port <port>
+//		password <password>
+//		tls
+//		...
+//	}
+func unmarshalRedisFallback(d *caddyfile.Dispenser) (*RedisConfig, error) {
+	config := new(RedisConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if name := d.Val(); name == "sentinel" || name == "cluster" {
+			return nil, d.Errf("fallback_redis can't use %s", name)
+		}
+		handled, err := config.unmarshalCaddyfileDirective(d)
+		if err != nil {
+			return nil, err
+		}
+		if !handled {
+			return nil, d.Errf("Unknown fallback_redis field: %s", d.Val())
+		}
+	}
+
+	if _, err := config.fallbackOptions(); err != nil {
+		return nil, d.Err(err.Error())
+	}
+
+	return config, nil
+}
+
+// redisTopology selects how the Redis nodes are found: through Sentinel
+// when masterName is set, as a cluster when clusterAddrs is set, and
+// otherwise the single node in redis.Options.
+type redisTopology struct {
+	masterName       string
+	sentinelAddrs    []string
+	sentinelUsername string
+	sentinelPassword string
+	clusterAddrs     []string
+}
+
+// unmarshalRedisSentinel parses the sentinel block shared by both modules
+// into c:
+//
+//	sentinel {
+//		master_name <name>
+//		addrs <host:port...>
+//		username <sentinel user>
+//		password <sentinel password>
+//	}
+func unmarshalRedisSentinel(d *caddyfile.Dispenser, c *RedisConfig) error {
+	if len(c.Cluster) > 0 {
+		return d.Err("sentinel and cluster can't be used together")
+	}
+
+	sentinel := new(RedisSentinelConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "master_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			sentinel.MasterName = d.Val()
+		case "addrs":
+			sentinel.Addrs = append(sentinel.Addrs, d.RemainingArgs()...)
+		case "username":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			sentinel.Username = d.Val()
+		case "password":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			sentinel.Password = d.Val()
+		default:
+			return d.Errf("Unknown sentinel field: %s", d.Val())
+		}
+	}
+
+	if sentinel.MasterName == "" || len(sentinel.Addrs) == 0 {
+		return d.Err("sentinel needs master_name and addrs")
+	}
+	c.Sentinel = sentinel
+
+	return nil
+}
+
+// unmarshalRedisCluster parses the seed nodes of the cluster directive
+// into c.
+func unmarshalRedisCluster(d *caddyfile.Dispenser, c *RedisConfig) error {
+	if c.Sentinel != nil {
+		return d.Err("sentinel and cluster can't be used together")
+	}
+
+	addrs := d.RemainingArgs()
+	if len(addrs) == 0 {
+		return d.ArgErr()
+	}
+	c.Cluster = append(c.Cluster, addrs...)
+
+	return nil
+}
+
+// newRedisClient returns a client for topology, taking the remaining
+// connection settings from opts.
+func newRedisClient(opts *redis.Options, topology redisTopology) redis.UniversalClient {
+	switch {
+	case topology.masterName != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       topology.masterName,
+			SentinelAddrs:    topology.sentinelAddrs,
+			SentinelUsername: topology.sentinelUsername,
+			SentinelPassword: topology.sentinelPassword,
+			Username:         opts.Username,
+			Password:         opts.Password,
+			DB:               opts.DB,
+			DialTimeout:      opts.DialTimeout,
+			ReadTimeout:      opts.ReadTimeout,
+			WriteTimeout:     opts.WriteTimeout,
+			TLSConfig:        opts.TLSConfig,
+			PoolSize:         opts.PoolSize,
+			MinIdleConns:     opts.MinIdleConns,
+			MaxIdleConns:     opts.MaxIdleConns,
+			ConnMaxIdleTime:  opts.ConnMaxIdleTime,
+			ConnMaxLifetime:  opts.ConnMaxLifetime,
+			MaxRetries:       opts.MaxRetries,
+			MinRetryBackoff:  opts.MinRetryBackoff,
+			MaxRetryBackoff:  opts.MaxRetryBackoff,
+		})
+	case len(topology.clusterAddrs) > 0:
+		// clusters have a single database, so opts.DB doesn't apply
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:           topology.clusterAddrs,
+			Username:        opts.Username,
+			Password:        opts.Password,
+			DialTimeout:     opts.DialTimeout,
+			ReadTimeout:     opts.ReadTimeout,
+			WriteTimeout:    opts.WriteTimeout,
+			TLSConfig:       opts.TLSConfig,
+			PoolSize:        opts.PoolSize,
+			MinIdleConns:    opts.MinIdleConns,
+			MaxIdleConns:    opts.MaxIdleConns,
+			ConnMaxIdleTime: opts.ConnMaxIdleTime,
+			ConnMaxLifetime: opts.ConnMaxLifetime,
+			MaxRetries:      opts.MaxRetries,
+			MinRetryBackoff: opts.MinRetryBackoff,
+			MaxRetryBackoff: opts.MaxRetryBackoff,
+		})
+	default:
+		return redis.NewClient(opts)
+	}
+}
+
+// redisClients shares clients between module instances with the same
+// connection settings, across config reloads.
+var redisClients = caddy.NewUsagePool()
+
+// pooledRedisClient closes the client once its last user releases it.
+type pooledRedisClient struct {
+	redis.UniversalClient
+}
+
+// Destruct implements caddy.Destructor.
+func (c pooledRedisClient) Destruct() error {
+	return c.Close()
+}
+
+// acquireRedisClient returns a client for opts and topology, shared with
+// other instances using the same settings, and the key to release it
+// with. Settings holding a TLS config or credentials provider can't be
+// compared, so those get a client of their own and an empty key.
+func acquireRedisClient(opts *redis.Options, topology redisTopology) (redis.UniversalClient, string, error) {
+	if opts.TLSConfig != nil || opts.CredentialsProvider != nil {
+		return newRedisClient(opts, topology), "", nil
+	}
+
+	key := fmt.Sprintf("%s|%s|%d|%s|%s|%s|%s|%s|%d|%d|%d|%s|%s|%d|%s|%s|%s|%v|%s|%s|%v",
+		opts.Network, opts.Addr, opts.DB, opts.Username, opts.Password,
+		opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout,
+		opts.PoolSize, opts.MinIdleConns, opts.MaxIdleConns,
+		opts.ConnMaxIdleTime, opts.ConnMaxLifetime,
+		opts.MaxRetries, opts.MinRetryBackoff, opts.MaxRetryBackoff,
+		topology.masterName, topology.sentinelAddrs, topology.sentinelUsername, topology.sentinelPassword,
+		topology.clusterAddrs)
+	client, _, err := redisClients.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return pooledRedisClient{newRedisClient(opts, topology)}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return client.(pooledRedisClient).UniversalClient, key, nil
+}
+
+// releaseRedisClient closes client, or drops a reference to it when it
+// is shared under key.
+func releaseRedisClient(client redis.UniversalClient, key string) error {
+	// Provision failed before connecting
+	if client == nil {
+		return nil
+	}
+	if key == "" {
+		return client.Close()
+	}
+
+	_, err := redisClients.Delete(key)
+	return err
+}
+
+// subscribeInvalidations calls evict with the payload of every message on
+// channel, a host or SNI to drop from the cache, until ctx is done.
+// go-redis resubscribes by itself after connection failures.
+func subscribeInvalidations(ctx context.Context, client redis.UniversalClient, channel string, logger *zap.SugaredLogger, evict func(name string)) {
+	pubsub := client.Subscribe(ctx, channel)
+
+	go func() {
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				logger.Debugf("Invalidating %s", msg.Payload)
+				evict(msg.Payload)
+			}
+		}
+	}()
+}
+
+// subscribeKeyspace calls changed with the name of every key matching
+// pattern in db that is written, deleted or expires, until ctx is done.
+// It needs notify-keyspace-events to include K and the hash, generic and
+// expired events, see missingKeyspaceEvents; when the server reports
+// otherwise it logs a warning and doesn't subscribe, so entries only
+// expire by TTL. Servers that refuse CONFIG GET are subscribed to anyway.
+func subscribeKeyspace(ctx context.Context, client redis.UniversalClient, db int, pattern string, logger *zap.SugaredLogger, changed func(key string)) {
+	checkCtx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	config, err := client.ConfigGet(checkCtx, "notify-keyspace-events").Result()
+	cancel()
+	if err != nil {
+		logger.Warnf("Reading notify-keyspace-events, subscribing to keyspace events anyway: %v", err)
+	} else if flags := config["notify-keyspace-events"]; missingKeyspaceEvents(flags) != "" {
+		logger.Warnf("Keyspace notifications are incomplete (notify-keyspace-events %q lacks %q), cached entries only expire by TTL; set it to e.g. \"Kghx\"", flags, missingKeyspaceEvents(flags))
+		return
+	}
+
+	channelPrefix := fmt.Sprintf("__keyspace@%d__:", db)
+	pubsub := client.PSubscribe(ctx, channelPrefix+pattern)
+
+	go func() {
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				key := strings.TrimPrefix(msg.Channel, channelPrefix)
+				logger.Debugf("Key %s changed (%s)", key, msg.Payload)
+				changed(key)
+			}
+		}
+	}()
+}
+
+// missingKeyspaceEvents returns the notify-keyspace-events classes flags
+// lacks for keyspace notifications of writes (h), deletions (g) and
+// expiry (x) of hash records, where A stands for all of them.
+func missingKeyspaceEvents(flags string) string {
+	var missing string
+	if !strings.Contains(flags, "K") {
+		missing += "K"
+	}
+	if strings.Contains(flags, "A") {
+		return missing
+	}
+	for _, class := range []string{"g", "h", "x"} {
+		if !strings.Contains(flags, class) {
+			missing += class
+		}
+	}
+
+	return missing
+}
+
+// redisReplicas spreads reads over read replicas, round robin, falling
+// back to the primary when a replica fails, and to the fallback Redis, if
+// any, when the primary fails too.
+type redisReplicas struct {
+	clients     []redis.UniversalClient
+	keys        []string
+	next        uint32
+	fallback    redis.UniversalClient
+	fallbackKey string
+	logger      *zap.SugaredLogger
+}
+
+// acquireRedisReplicas returns clients for addrs with the remaining
+// settings of opts, and for fallback if set, or nil without either.
+func acquireRedisReplicas(opts *redis.Options, addrs []string, fallback *redis.Options, logger *zap.SugaredLogger) (*redisReplicas, error) {
+	if len(addrs) == 0 && fallback == nil {
+		return nil, nil
+	}
+
+	replicas := &redisReplicas{logger: logger}
+	if fallback != nil {
+		client, key, err := acquireRedisClient(fallback, redisTopology{})
+		if err != nil {
+			return nil, err
+		}
+		replicas.fallback, replicas.fallbackKey = client, key
+	}
+	for _, addr := range addrs {
+		replicaOpts := *opts
+		replicaOpts.Network, replicaOpts.Addr = "", addr
+		client, key, err := acquireRedisClient(&replicaOpts, redisTopology{})
+		if err != nil {
+			replicas.release()
+			return nil, err
+		}
+		replicas.clients = append(replicas.clients, client)
+		replicas.keys = append(replicas.keys, key)
+	}
+
+	return replicas, nil
+}
+
+// read runs fn against the next replica, against primary if that fails,
+// and against the fallback Redis if primary fails too. Without replicas
+// it starts with primary.
+func (r *redisReplicas) read(primary redis.UniversalClient, fn func(client redis.UniversalClient) error) error {
+	if r == nil {
+		return fn(primary)
+	}
+
+	if len(r.clients) > 0 {
+		i := atomic.AddUint32(&r.next, 1) % uint32(len(r.clients))
+		err := fn(r.clients[i])
+		if !isConnectionError(err) {
+			return err
+		}
+		r.logger.Warnf("Reading from replica %s failed, using primary: %v", r.clients[i], err)
+	}
+
+	err := fn(primary)
+	if r.fallback == nil || !isConnectionError(err) {
+		return err
+	}
+
+	r.logger.Warnf("Reading from primary Redis failed, using fallback_redis: %v", err)
+	if err := fn(r.fallback); err != nil {
+		return err
+	}
+	r.logger.Debugf("Read served by fallback_redis %s", r.fallback)
+
+	return nil
+}
+
+// isConnectionError reports whether err means Redis couldn't be used, as
+// opposed to success, a missing key, an error reply such as WRONGTYPE or
+// a canceled request, none of which another node would change.
+func isConnectionError(err error) bool {
+	var reply redis.Error
+	return err != nil && err != redis.Nil && !isCanceled(err) && !errors.As(err, &reply)
+}
+
+func (r *redisReplicas) release() error {
+	if r == nil {
+		return nil
+	}
+
+	var firstErr error
+	for i, client := range r.clients {
+		if err := releaseRedisClient(client, r.keys[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if r.fallback != nil {
+		if err := releaseRedisClient(r.fallback, r.fallbackKey); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// redisHealth is the last known result of pinging Redis.
+type redisHealth struct {
+	mu      sync.Mutex
+	up      bool
+	checked time.Time
+	err     error
+}
+
+// watchRedisHealth pings client now and then every redisHealthInterval
+// until ctx is done, logging changes of connectivity.
+func watchRedisHealth(ctx context.Context, client redis.UniversalClient, logger *zap.SugaredLogger) *redisHealth {
+	h := new(redisHealth)
+	h.check(ctx, client, logger)
+
+	go func() {
+		ticker := time.NewTicker(redisHealthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.check(ctx, client, logger)
+			}
+		}
+	}()
+
+	return h
+}
+
+func (h *redisHealth) check(ctx context.Context, client redis.UniversalClient, logger *zap.SugaredLogger) {
+	pingCtx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	err := client.Ping(pingCtx).Err()
+	if ctx.Err() != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch {
+	case err != nil && (h.up || h.checked.IsZero()):
+		logger.Warnf("Redis is unreachable: %v", err)
+	case err == nil && !h.up && !h.checked.IsZero():
+		logger.Info("Redis is reachable again")
+	}
+	h.up, h.checked, h.err = err == nil, time.Now(), err
+}
+
+// status returns the result of the last check.
+func (h *redisHealth) status() (up bool, checked time.Time, err error) {
+	if h == nil {
+		return false, time.Time{}, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.up, h.checked, h.err
+}
@@ -0,0 +1,100 @@
+package guard
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestAcquireRedisClientShares(t *testing.T) {
+	// each module passes its own options, go-redis fills in defaults
+	acquire := func(db int) (redis.UniversalClient, string) {
+		t.Helper()
+		client, key, err := acquireRedisClient(&redis.Options{Addr: "127.0.0.1:6379", DB: db}, redisTopology{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { releaseRedisClient(client, key) })
+		return client, key
+	}
+
+	first, firstKey := acquire(0)
+	second, secondKey := acquire(0)
+	if firstKey == "" || first != second || firstKey != secondKey {
+		t.Error("modules with the same connection settings don't share a client")
+	}
+	if other, otherKey := acquire(1); other == first || otherKey == firstKey {
+		t.Error("modules with different connection settings share a client")
+	}
+}
+
+func TestMissingKeyspaceEvents(t *testing.T) {
+	tests := []struct {
+		flags string
+		want  string
+	}{
+		{flags: "", want: "Kghx"},
+		{flags: "Kghx", want: ""},
+		{flags: "KA", want: ""},
+		{flags: "AK", want: ""},
+		{flags: "Kh", want: "gx"},
+		{flags: "Kgh", want: "x"},
+		{flags: "Eghx", want: "K"},
+		{flags: "EA", want: "K"},
+		{flags: "KEA", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := missingKeyspaceEvents(tt.flags); got != tt.want {
+			t.Errorf("missingKeyspaceEvents(%q) = %q, want %q", tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestCleanupAfterFailedProvision(t *testing.T) {
+	modules := map[string]interface {
+		caddy.Provisioner
+		caddy.CleanerUpper
+	}{
+		"routing": &Middleware{Mode: "nope"},
+		"tls":     &RedisCertGetter{Codecs: []string{"nope"}},
+	}
+
+	for name, module := range modules {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			if err := module.Provision(ctx); err == nil {
+				t.Fatal("Provision() succeeded with an invalid option")
+			}
+			if err := module.Cleanup(); err != nil {
+				t.Errorf("Cleanup() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestRedisConfigReadReplicas(t *testing.T) {
+	replicas := []string{"10.0.0.2:6379"}
+	tests := []struct {
+		name    string
+		config  RedisConfig
+		wantErr bool
+	}{
+		{name: "single node", config: RedisConfig{ReadReplicas: replicas}},
+		{name: "sentinel", config: RedisConfig{ReadReplicas: replicas, Sentinel: &RedisSentinelConfig{MasterName: "mymaster", Addrs: []string{"10.0.0.1:26379"}}}, wantErr: true},
+		{name: "cluster", config: RedisConfig{ReadReplicas: replicas, Cluster: []string{"10.0.0.1:6379"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if _, _, err := tt.config.options(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: options() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if _, err := (RedisConfig{Host: "10.0.0.1", ReadReplicas: replicas}).fallbackOptions(); err == nil {
+		t.Error("fallbackOptions() accepted read_replicas")
+	}
+}
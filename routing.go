@@ -2,10 +2,17 @@ package guard
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -13,6 +20,7 @@ import (
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 func init() {
@@ -20,15 +28,247 @@ func init() {
 	httpcaddyfile.RegisterHandlerDirective("routing", parseCaddyfile)
 }
 
+// domainPlaceholder matches the {{field}} placeholders of Domain.
+var domainPlaceholder = regexp.MustCompile(`\{\{([^{}]+)\}\}`)
+
+// domainFields returns the fields referenced by domain, other than token.
+func domainFields(domain string) []string {
+	var fields []string
+	for _, match := range domainPlaceholder.FindAllStringSubmatch(domain, -1) {
+		if field := match[1]; "{{"+field+"}}" != tokenPlaceholder {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// errLookupTimeout is returned when a lookup exceeds LookupTimeout.
+var errLookupTimeout = errors.New("redis lookup timed out")
+
+// errEmptyToken is returned when the token field exists but is empty.
+var errEmptyToken = errors.New("token field is empty")
+
+const (
+	// tokenPlaceholder is replaced with the token in Domain.
+	tokenPlaceholder = "{{token}}"
+	// Placeholders of KeyTemplate.
+	prefixPlaceholder = "{{prefix}}"
+	hostPlaceholder   = "{{host}}"
+	methodPlaceholder = "{{method}}"
+	// timeoutVar is the name of the var holding the per-host upstream timeout.
+	timeoutVar = "routing_timeout"
+	// upstreamVar is the name of the var holding the target in upstream mode.
+	upstreamVar = "routing_upstream"
+	// Values of Mode.
+	modeHost     = "host"
+	modeUpstream = "upstream"
+	// Values of MatchOn.
+	matchOnHost = "host"
+	matchOnSNI  = "sni"
+	// Values of PathTrailingSlash.
+	trailingSlashKeep  = "keep"
+	trailingSlashStrip = "strip"
+)
+
 type Middleware struct {
+	// Redis connection settings, inlined in the JSON config.
+	RedisConfig
+	// Secondary Redis for reads that fail on the primary.
+	FallbackRedis *RedisConfig `json:"fallback_redis,omitempty"`
+
 	Prefix   string `json:"prefix,omitempty"`
 	TokenKey string `json:"tokenKey,omitempty"`
 	Domain   string `json:"domain"`
+	// Further token fields, tried in order after TokenKey. The first
+	// non-empty one is used, e.g. ["token"] after a new "token_v2".
+	TokenKeys []string `json:"tokenKeys,omitempty"`
+	// Type of the record holding the token: "hash" (default) reads
+	// TokenKey, "list" and "set" make the key a Redis list or set of
+	// tokens, one picked per request in turn or at random.
+	TokenSource string `json:"token_source,omitempty"`
+	// What to do with the target built from Domain: "host" (default)
+	// replaces the Host header, "upstream" keeps it and stores the target
+	// in the routing_upstream var for reverse_proxy to dial.
+	Mode string `json:"mode,omitempty"`
+	// Redis key to look up, with {{prefix}}, {{host}} and {{method}}
+	// placeholders. Default "{{prefix}}:{{host}}". When it uses
+	// {{method}} and the key has no token, "{{prefix}}:{{host}}" is tried.
+	KeyTemplate string `json:"key_template,omitempty"`
+	// How the host is put into the key: "none" (default) as is, "sha256"
+	// as the lowercase hex SHA-256 of the host, after normalization.
+	KeyHash string `json:"key_hash,omitempty"`
+	// Rewrite every routed host to the fixed Domain, which then must not
+	// contain {{token}}. The token only decides whether a host is routed.
+	StaticTarget bool `json:"static_target,omitempty"`
+	// Optional hash field holding a per-host upstream timeout, exposed
+	// to later handlers as {http.vars.routing_timeout}.
+	TimeoutKey string `json:"timeoutKey,omitempty"`
+	// Optional hash field holding a path prefix prepended to the request
+	// path of routed requests, e.g. "/tenants/acme".
+	PathKey string `json:"path_key,omitempty"`
+	// Collapse runs of slashes in prefixed paths, e.g. "/a//b" to "/a/b".
+	PathCollapseSlashes bool `json:"path_collapse_slashes,omitempty"`
+	// Trailing slash of prefixed paths: "keep" (default) leaves it as
+	// requested, "strip" removes it, so "/" becomes the bare prefix.
+	PathTrailingSlash string `json:"path_trailing_slash,omitempty"`
+	// Optional hash field holding the canonical host. Requests for any
+	// other host, ignoring case and port, are redirected to it with
+	// CanonicalStatus (default 301), keeping their port.
+	CanonicalKey    string `json:"canonicalKey,omitempty"`
+	CanonicalStatus int    `json:"canonical_status,omitempty"`
+	// Query parameters added on rewrite, values may contain {{token}}.
+	// Parameters already in the request are kept unless QueryMerge is
+	// "append", which adds the configured value alongside them.
+	Query      map[string]string `json:"query,omitempty"`
+	QueryMerge string            `json:"query_merge,omitempty"`
+	// What to do when the token field exists but is empty: "pass"
+	// (default) serves the request unchanged, "error" fails with 502.
+	EmptyToken string `json:"empty_token,omitempty"`
+	// Fail requests for hosts without a token instead of serving them
+	// unchanged.
+	RequireToken bool `json:"require_token,omitempty"`
+	// Response to requests failed by RequireToken, by default a 404
+	// error for handle_errors to render.
+	OnMissing *MissingResponse `json:"on_missing,omitempty"`
+	// Record the original host and proto of rewritten requests, either as
+	// X-Forwarded-Host/Proto ("legacy") or as a Forwarded header
+	// ("rfc7239"). Existing values are appended to.
+	ForwardedHeaders string `json:"forwarded_headers,omitempty"`
+	// Pseudonym added to the Via header of rewritten requests. Off when empty.
+	Via string `json:"via,omitempty"`
+	// Codecs applied in order to the raw Redis value, e.g. ["base64"].
+	Codecs []string `json:"codecs,omitempty"`
+	// Maximum number of concurrent Redis lookups, 0 means unlimited.
+	MaxConcurrentLookups int `json:"max_concurrent_lookups,omitempty"`
+	// How long a lookup waits for a free slot before failing.
+	LookupQueueTimeout caddy.Duration `json:"lookup_queue_timeout,omitempty"`
+	// Longest a Redis lookup may take before the request fails with 504.
+	// Off when 0, lookups are then only bounded by the Redis timeouts and
+	// the request itself.
+	LookupTimeout caddy.Duration `json:"lookup_timeout,omitempty"`
+	// Stop reading Redis for BreakerCooldown (default 10s) after this
+	// many consecutive connection failures, failing lookups with 503,
+	// then let one request probe it per cooldown. Off when 0.
+	BreakerThreshold int            `json:"breaker_threshold,omitempty"`
+	BreakerCooldown  caddy.Duration `json:"breaker_cooldown,omitempty"`
+	// Write 1 in LogSample routing decision logs, 0 or 1 logs all of them.
+	LogSample int `json:"log_sample,omitempty"`
+	// Level of the per-request "Routed request" log, default "debug".
+	DecisionLogLevel string `json:"decision_log_level,omitempty"`
+	// Add the token to the "Routed request" log. Off by default, as
+	// tokens may be secrets and logs are often kept and shared widely.
+	LogToken bool `json:"log_token,omitempty"`
+	// Log and count rewrites and redirects without applying them.
+	DryRun bool `json:"dry_run,omitempty"`
+	// Share one Redis lookup between concurrent requests for the same host.
+	DedupeLookups bool `json:"dedupe_lookups,omitempty"`
+	// Serve an expired cache entry while one background lookup refreshes
+	// it, instead of waiting for Redis. Needs CacheTTL.
+	StaleWhileRefresh bool `json:"stale_while_refresh,omitempty"`
+	// How long looked up records are kept in memory per host. Off when 0.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	// Maximum number of hosts in the cache, default 10000.
+	CacheSize int `json:"cache_size,omitempty"`
+	// How long hosts without a record are remembered, so repeated misses
+	// skip Redis. Keep it short so new records show up soon. When set,
+	// misses use this TTL instead of CacheTTL. Off when 0.
+	NegativeCacheTTL caddy.Duration `json:"negative_cache_ttl,omitempty"`
+	// Fail provisioning when Redis doesn't answer a PING. Defaults to
+	// true; the connection keeps being checked either way.
+	PingOnStart *bool `json:"ping_on_start,omitempty"`
+	// Redis pub/sub channel whose messages name a host to drop from the
+	// cache, e.g. after changing its route. Needs CacheTTL.
+	InvalidateChannel string `json:"invalidate_channel,omitempty"`
+	// Estimate distinct routed hosts, as looked up, per TenantWindow
+	// (default 1h), either "memory" (per instance) or "hll" (a
+	// HyperLogLog at TenantCounterKey in Redis, shared by all instances
+	// and written in batches about once a second).
+	TenantCounter    string         `json:"tenant_counter,omitempty"`
+	TenantWindow     caddy.Duration `json:"tenant_window,omitempty"`
+	TenantCounterKey string         `json:"tenant_counter_key,omitempty"`
+	// File path or http(s) URL of a JSON document with "username" and
+	// "password", read on every (re)connect to follow secret rotation.
+	CredentialsSource string `json:"credentials_source,omitempty"`
+	// Full Redis key of a sentinel record whose TokenKey field must be
+	// set, checked in Provision. Off when empty.
+	SelfTestKey string `json:"self_test_key,omitempty"`
+	// Longest host accepted for lookups, default 253. Longer hosts are
+	// rejected, or truncated when LongHost is "truncate".
+	MaxHostLength int    `json:"max_host_length,omitempty"`
+	LongHost      string `json:"long_host,omitempty"`
+	// Only check that the host's key exists, without reading a token or
+	// rewriting: existing hosts are passed on, others get DenyStatus.
+	ExistsOnly bool `json:"exists_only,omitempty"`
+	// Status for hosts without a key in ExistsOnly mode, default 403.
+	DenyStatus int `json:"deny_status,omitempty"`
+	// How to treat requests whose host is an IP address: "skip" (default)
+	// passes them on unrouted, "lookup" looks them up like any host.
+	IPHosts string `json:"ip_hosts,omitempty"`
+	// Look hosts up exactly as sent instead of lowercased and without
+	// port.
+	RawHost bool `json:"raw_host,omitempty"`
+	// What to look up: "host" (default) the Host header, or "sni" the TLS
+	// server name of the connection, falling back to the Host header for
+	// plain HTTP and clients sending no SNI.
+	MatchOn string `json:"match_on,omitempty"`
+	// Answer 421 Misdirected Request, so the client opens a connection
+	// for the host, to requests whose Host differs from the TLS server
+	// name of their connection (as with HTTP/2 connection reuse) and
+	// either has no token or, with MatchOn "sni", would be routed by the
+	// other name.
+	RejectMisdirected bool `json:"reject_misdirected,omitempty"`
+	// Hash field holding the hex HMAC-SHA256 of the decoded token under
+	// SignatureSecret. When set, tokens without a valid signature fail
+	// with 502 instead of being routed.
+	SignatureKey    string `json:"signature_key,omitempty"`
+	SignatureSecret string `json:"signature_secret,omitempty"`
+	// Normalize the rewritten host and fail with 502 instead of proxying
+	// when it is not a valid hostname, e.g. due to corrupt tokens.
+	ValidateTarget bool `json:"validate_target,omitempty"`
+	// Expose lookup and connection pool internals on the admin endpoint
+	// at /dynamic-routing/debug.
+	DebugStats bool `json:"debug_stats,omitempty"`
+	// Count requests per host in host_requests_total, labeling hosts in
+	// MetricsTrackedHosts by name and the rest by "tld" or as "other"
+	// ("tracked"). Off when empty.
+	MetricsHosts        string   `json:"metrics_hosts,omitempty"`
+	MetricsTrackedHosts []string `json:"metrics_tracked_hosts,omitempty"`
 
-	ctx          context.Context
-	redisClient  *redis.Client
-	redisOptions redis.Options
-	logger       *zap.SugaredLogger
+	codecs     codecChain
+	hostLength hostLengthPolicy
+	hostLabels *hostLabeler
+	limiter    *lookupLimiter
+	breaker    *circuitBreaker
+	lookups    *lookupGroup
+	ops        *inFlightOps
+	tenants    tenantCounter
+	rotation   *tokenRotation
+	// domainFields are the hash fields referenced by Domain besides the token.
+	domainFields []string
+	records      *ttlCache[map[string]string]
+	misses       *ttlCache[struct{}]
+	// rendered on_missing responses by host, with on_missing cache
+	missingResponses *ttlCache[string]
+	// background scopes work not tied to one request, such as shared
+	// lookups and the tenant counter, and is canceled in Cleanup. It
+	// isn't derived from the caddy.Context, which is canceled before
+	// Cleanup drains the lookups in flight.
+	background    context.Context
+	cancel        context.CancelFunc
+	redisClient   redis.UniversalClient
+	redisOptions  redis.Options
+	redisTopology redisTopology
+	// fallbackRedis is the secondary Redis for failed reads, if any.
+	fallbackRedis *redis.Options
+	// redisKey is the key of a shared client in redisClients, if any.
+	redisKey  string
+	replicas  *redisReplicas
+	health    *redisHealth
+	logger    *zap.SugaredLogger
+	decisions *zap.SugaredLogger
+	// decisionLevel is the parsed DecisionLogLevel.
+	decisionLevel zapcore.Level
 }
 
 func (Middleware) CaddyModule() caddy.ModuleInfo {
@@ -40,58 +280,1108 @@ func (Middleware) CaddyModule() caddy.ModuleInfo {
 
 // Provision implements caddy.Provisioner.
 func (m *Middleware) Provision(ctx caddy.Context) error {
-	m.ctx = ctx
+	m.background, m.cancel = context.WithCancel(context.Background())
 	m.logger = ctx.Logger().Sugar()
-	m.redisClient = redis.NewClient(&m.redisOptions)
+	m.decisions = newDecisionLogger(ctx.Logger(), m.LogSample)
+	m.decisionLevel = zapcore.DebugLevel
+	if m.DecisionLogLevel != "" {
+		level, err := zapcore.ParseLevel(m.DecisionLogLevel)
+		if err != nil {
+			return fmt.Errorf("invalid decision_log_level: %v", err)
+		}
+		m.decisionLevel = level
+	}
+
+	switch m.EmptyToken {
+	case "", "pass", policyError:
+	default:
+		return fmt.Errorf("unknown empty_token policy: %s", m.EmptyToken)
+	}
+
+	if m.OnMissing != nil {
+		if !m.RequireToken {
+			return fmt.Errorf("on_missing needs require_token")
+		}
+		if err := m.OnMissing.validate(); err != nil {
+			return fmt.Errorf("on_missing: %v", err)
+		}
+	}
+	if m.DenyStatus != 0 && (m.DenyStatus < 400 || m.DenyStatus > 599) {
+		return fmt.Errorf("invalid deny_status: %d", m.DenyStatus)
+	}
+
+	switch m.Mode {
+	case "", modeHost, modeUpstream:
+	default:
+		return fmt.Errorf("unknown mode: %s", m.Mode)
+	}
+
+	switch m.MatchOn {
+	case "", matchOnHost, matchOnSNI:
+	default:
+		return fmt.Errorf("unknown match_on: %s", m.MatchOn)
+	}
+
+	if err := checkKeyHash(m.KeyHash); err != nil {
+		return err
+	}
+
+	switch m.PathTrailingSlash {
+	case "", trailingSlashKeep, trailingSlashStrip:
+	default:
+		return fmt.Errorf("unknown path_trailing_slash: %s", m.PathTrailingSlash)
+	}
+
+	switch m.IPHosts {
+	case "", "skip", "lookup":
+	default:
+		return fmt.Errorf("unknown ip_hosts policy: %s", m.IPHosts)
+	}
+
+	switch m.TokenSource {
+	case "", tokenSourceHash, tokenSourceSet:
+	case tokenSourceList:
+		m.rotation = newTokenRotation()
+	default:
+		return fmt.Errorf("unknown token_source: %s", m.TokenSource)
+	}
+
+	if err := validateForwardedFormat(m.ForwardedHeaders); err != nil {
+		return err
+	}
+
+	switch m.QueryMerge {
+	case "", "keep", "append":
+	default:
+		return fmt.Errorf("unknown query_merge: %s", m.QueryMerge)
+	}
+
+	m.domainFields = domainFields(m.Domain)
+	hasToken := strings.Contains(m.Domain, tokenPlaceholder) || len(m.domainFields) > 0
+	if m.StaticTarget && hasToken {
+		return fmt.Errorf("static_target is set but domain %q has placeholders", m.Domain)
+	}
+
+	codecs, err := newCodecChain(m.Codecs)
+	if err != nil {
+		return err
+	}
+	m.codecs = codecs
+
+	m.hostLength, err = newHostLengthPolicy(m.MaxHostLength, m.LongHost)
+	if err != nil {
+		return err
+	}
+	m.hostLabels, err = newHostLabeler(metricsModuleRouting, m.MetricsHosts, m.MetricsTrackedHosts)
+	if err != nil {
+		return err
+	}
+	m.limiter = newLookupLimiter(metricsModuleRouting, m.MaxConcurrentLookups, time.Duration(m.LookupQueueTimeout))
+	m.breaker = newCircuitBreaker(m.BreakerThreshold, time.Duration(m.BreakerCooldown), m.logger)
+	m.ops = new(inFlightOps)
+	m.records = newTTLCache[map[string]string](time.Duration(m.CacheTTL), m.CacheSize)
+	m.misses = newTTLCache[struct{}](time.Duration(m.NegativeCacheTTL), m.CacheSize)
+	if m.OnMissing != nil && m.OnMissing.Cache {
+		if m.misses == nil {
+			return fmt.Errorf("on_missing cache needs negative_cache_ttl")
+		}
+		m.missingResponses = newTTLCache[string](time.Duration(m.NegativeCacheTTL), m.CacheSize)
+	}
+	if m.StaleWhileRefresh && m.records == nil {
+		return fmt.Errorf("stale_while_refresh needs cache_ttl")
+	}
+	if m.DedupeLookups || m.StaleWhileRefresh {
+		m.lookups = new(lookupGroup)
+	}
+
+	m.redisOptions, m.redisTopology, err = m.RedisConfig.options()
+	if err != nil {
+		return err
+	}
+	if m.FallbackRedis != nil {
+		if m.fallbackRedis, err = m.FallbackRedis.fallbackOptions(); err != nil {
+			return err
+		}
+	}
+	if m.CredentialsSource != "" {
+		m.redisOptions.CredentialsProvider = newCredentialsProvider(m.CredentialsSource, m.redisOptions.Username, m.redisOptions.Password, m.logger)
+	}
+	if topology := m.redisTopology; topology.masterName != "" || len(topology.clusterAddrs) > 0 {
+		if m.CredentialsSource != "" {
+			m.logger.Warn("credentials_source is only supported with a single Redis node, using static credentials")
+		}
+		if len(topology.clusterAddrs) > 0 && m.redisOptions.DB != 0 {
+			m.logger.Warnf("db %d is ignored in cluster mode", m.redisOptions.DB)
+		}
+	}
+	m.redisClient, m.redisKey, err = acquireRedisClient(&m.redisOptions, m.redisTopology)
+	if err != nil {
+		return err
+	}
+	m.replicas, err = acquireRedisReplicas(&m.redisOptions, m.ReadReplicas, m.fallbackRedis, m.logger)
+	if err != nil {
+		return err
+	}
+	m.health = watchRedisHealth(m.background, m.redisClient, m.logger)
+	if up, _, err := m.health.status(); !up && (m.PingOnStart == nil || *m.PingOnStart) {
+		return fmt.Errorf("pinging redis: %v", err)
+	}
+	if m.DebugStats {
+		registerDebugSource(m, m.debugStats)
+	}
+	if m.records != nil {
+		registerCacheSource(m, metricsModuleRouting, m.Prefix, describedCache[map[string]string]{m.records, m.describeRecord})
+	}
+
+	if m.SelfTestKey != "" {
+		if err := m.selfTest(ctx); err != nil {
+			return fmt.Errorf("self test: %v", err)
+		}
+	}
+
+	tenantKey := m.TenantCounterKey
+	if tenantKey == "" {
+		tenantKey = "routing:tenants"
+	}
+	if m.InvalidateChannel != "" {
+		if m.records == nil && m.misses == nil {
+			return fmt.Errorf("invalidate_channel needs cache_ttl or negative_cache_ttl")
+		}
+		subscribeInvalidations(m.background, m.redisClient, m.InvalidateChannel, m.logger, m.evict)
+	}
+
+	m.tenants, err = newTenantCounter(m.background, m.TenantCounter, time.Duration(m.TenantWindow), m.redisClient, tenantKey, m.logger)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// selfTest checks that the sentinel record has a token.
+func (m Middleware) selfTest(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	token, err := m.redisClient.HGet(ctx, m.SelfTestKey, m.TokenKey).Result()
+	if err != nil {
+		return fmt.Errorf("reading field %s of %s: %v", m.TokenKey, m.SelfTestKey, err)
+	}
+	if token == "" {
+		return fmt.Errorf("field %s of %s is empty", m.TokenKey, m.SelfTestKey)
+	}
+
+	return nil
+}
+
+// Validate implements caddy.Validator, rejecting combinations that would
+// otherwise only fail or misroute at request time.
+func (m *Middleware) Validate() error {
+	if err := validateRedisAddrs(&m.redisOptions, m.redisTopology, m.ReadReplicas); err != nil {
+		return err
+	}
+	if m.fallbackRedis != nil {
+		if err := validateRedisAddrs(m.fallbackRedis, redisTopology{}, nil); err != nil {
+			return fmt.Errorf("fallback_redis: %v", err)
+		}
+	}
+	if m.Prefix == "" && (m.KeyTemplate == "" || strings.Contains(m.KeyTemplate, prefixPlaceholder)) {
+		return fmt.Errorf("prefix can't be empty")
+	}
+	if m.KeyTemplate != "" && !strings.Contains(m.KeyTemplate, hostPlaceholder) {
+		return fmt.Errorf("key_template %q has no %s placeholder, every host would share one key", m.KeyTemplate, hostPlaceholder)
+	}
+	if m.ExistsOnly {
+		return nil
+	}
+
+	if m.TokenKey == "" {
+		return fmt.Errorf("tokenKey can't be empty")
+	}
+	if m.SignatureKey != "" && m.SignatureSecret == "" {
+		return fmt.Errorf("signature_key is set without signature_secret")
+	}
+	if m.Domain == "" {
+		return fmt.Errorf("domain can't be empty")
+	}
+	if !m.StaticTarget && !strings.Contains(m.Domain, tokenPlaceholder) && len(m.domainFields) == 0 {
+		return fmt.Errorf("domain %q has no %s placeholder; set static_target to rewrite every routed host to it", m.Domain, tokenPlaceholder)
+	}
+	if m.TokenSource == tokenSourceList || m.TokenSource == tokenSourceSet {
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"tokenKeys", len(m.TokenKeys) > 0},
+			{"timeoutKey", m.TimeoutKey != ""},
+			{"canonicalKey", m.CanonicalKey != ""},
+			{"path_key", m.PathKey != ""},
+			{"signature_key", m.SignatureKey != ""},
+			{"self_test", m.SelfTestKey != ""},
+			{"a domain field placeholder", len(m.domainFields) > 0},
+		} {
+			if option.set {
+				return fmt.Errorf("%s reads hash fields and can't be used with token_source %s", option.name, m.TokenSource)
+			}
+		}
+	}
 
 	return nil
 }
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// get token from redis
-	token, err := m.redisClient.HGet(m.ctx, fmt.Sprintf("%s:%s", m.Prefix, r.Host), m.TokenKey).Result()
+	matched := m.matchedHost(r)
+	if m.IPHosts != "lookup" && isIPHost(matched) {
+		m.decisions.Debugw("Not routing IP host", "host", matched)
+		return next.ServeHTTP(w, r)
+	}
+
+	sni, misdirected := m.misdirected(r)
+	if misdirected && m.MatchOn == matchOnSNI {
+		return m.rejectMisdirected(w, r, next, sni)
+	}
+
+	dynamicRoutingMetrics.requests.WithLabelValues(metricsModuleRouting).Inc()
+
+	// get token and optional fields from redis
+	host, err := m.hostLength.apply(m.lookupHost(matched))
 	if err != nil {
-		return err
+		m.logger.Warnf("Rejecting host from %s: %v", r.RemoteAddr, err)
+		countError(metricsModuleRouting, errorTypeHost)
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	m.hostLabels.count(host)
+
+	if m.ExistsOnly {
+		return m.serveExistsOnly(w, r, next, host)
+	}
+
+	start := time.Now()
+	record, cache, err := m.fetch(r.Context(), m.lookupKey(host, r.Method))
+	if _, _, ok := m.token(record); err == nil && !ok && strings.Contains(m.KeyTemplate, methodPlaceholder) {
+		m.decisions.Debugw("No method-specific record, trying host key", "host", r.Host, "method", r.Method)
+		record, cache, err = m.fetch(r.Context(), m.lookupKey(host, ""))
+	}
+	lookupDuration := time.Since(start)
+	if isCanceled(err) {
+		m.decisions.Debugw("Lookup canceled", "host", r.Host, "error", err)
+		return caddyhttp.Error(statusClientClosedRequest, err)
+	}
+	if err != nil {
+		return lookupFailed(r.Host, err)
+	}
+
+	if canonical := record[m.CanonicalKey]; m.CanonicalKey != "" && canonical != "" && !sameHost(canonical, r.Host) {
+		return m.redirectToCanonical(w, r, next, canonical)
+	}
+
+	tokenField, token, ok := m.token(record)
+	if !ok {
+		m.decisions.Debugw("Token field missing", "host", r.Host, "field", m.TokenKey)
+		if misdirected {
+			return m.rejectMisdirected(w, r, next, sni)
+		}
+		if m.RequireToken {
+			return m.serveMissing(w, r, host)
+		}
+		return next.ServeHTTP(w, r)
+	}
+	if token == "" {
+		if m.EmptyToken == policyError {
+			m.logger.Warnf("Token field %s of %s is empty", tokenField, r.Host)
+			countError(metricsModuleRouting, errorTypeEmpty)
+			return caddyhttp.Error(http.StatusBadGateway, errEmptyToken)
+		}
+		m.decisions.Debugw("Token field empty, not rewriting", "host", r.Host, "field", tokenField)
+		return next.ServeHTTP(w, r)
+	}
+
+	token = m.selectToken(r.Host, token)
+	decoded, err := m.codecs.Decode([]byte(token))
+	if err != nil {
+		countError(metricsModuleRouting, errorTypeParse)
+		return newLookupError(ErrInvalidRecord, r.Host, err)
+	}
+	token = string(decoded)
+
+	if m.SignatureKey != "" {
+		if err := verifyTokenSignature([]byte(m.SignatureSecret), token, record[m.SignatureKey]); err != nil {
+			m.logger.Warnf("Not routing %s: %v", r.Host, err)
+			countError(metricsModuleRouting, errorTypeSignature)
+			return caddyhttp.Error(http.StatusBadGateway, err)
+		}
+	}
+
+	if m.tenants != nil {
+		m.tenants.observe(host)
+	}
+
+	if m.TimeoutKey != "" {
+		m.setTimeoutVar(r, record[m.TimeoutKey])
 	}
 
 	if token != "" {
-		newHost := strings.Replace(m.Domain, "{{token}}", token, 1)
-		m.logger.Debugf("Replacing %s to %s", r.Host, newHost)
-		r.Host = newHost
+		newHost, err := m.renderDomain(r, token, record)
+		if err != nil {
+			m.logger.Warnf("Not routing %s: %v", r.Host, err)
+			countError(metricsModuleRouting, errorTypeTarget)
+			return caddyhttp.Error(http.StatusBadGateway, err)
+		}
+		if m.ValidateTarget {
+			normalized, err := normalizeTarget(newHost)
+			if err != nil {
+				m.logger.Warnf("Not routing %s: %v", r.Host, err)
+				countError(metricsModuleRouting, errorTypeTarget)
+				return caddyhttp.Error(http.StatusBadGateway, err)
+			}
+			newHost = normalized
+		}
+		if m.DryRun {
+			m.decisions.Infow("Dry run, not replacing host", "from", r.Host, "to", newHost)
+			dynamicRoutingMetrics.dryRunRewrites.Inc()
+			return next.ServeHTTP(w, r)
+		}
+		fields := []zap.Field{
+			zap.String("host", r.Host),
+			zap.String("target", newHost),
+			zap.String("mode", m.modeName()),
+			zap.String("cache", cache),
+			zap.Duration("lookup_duration", lookupDuration),
+		}
+		if m.LogToken {
+			fields = append(fields, zap.String("token", token))
+		}
+		m.decisions.Desugar().Log(m.decisionLevel, "Routed request", fields...)
+		if m.Mode == modeUpstream {
+			caddyhttp.SetVar(r.Context(), upstreamVar, newHost)
+		} else {
+			m.recordForwarded(r)
+			r.Host = newHost
+		}
+		if prefix := record[m.PathKey]; m.PathKey != "" && prefix != "" {
+			m.prefixPath(r, prefix)
+		}
+		if len(m.Query) > 0 {
+			m.mergeQuery(r, token)
+		}
 	}
 
 	return next.ServeHTTP(w, r)
 }
 
+// prefixPath prepends prefix to the request path. The prefix is cleaned
+// to a rooted path without a trailing slash, so "tenants/acme/" and
+// "/tenants/acme" give the same result and ".." can't climb above the
+// root. The result is then tidied by PathCollapseSlashes and
+// PathTrailingSlash. The query is left as is.
+func (m Middleware) prefixPath(r *http.Request, prefix string) {
+	prefix = path.Clean("/" + prefix)
+	if prefix == "/" {
+		return
+	}
+
+	m.decisions.Debugw("Prefixing path", "host", r.Host, "prefix", prefix, "path", r.URL.Path)
+	if r.URL.RawPath == "" {
+		r.URL.Path = m.tidyPath(prefix + r.URL.Path)
+		return
+	}
+
+	// tidy the escaped form, where an encoded slash isn't a separator,
+	// and decode Path from it so both stay in step
+	raw := m.tidyPath((&url.URL{Path: prefix}).EscapedPath() + r.URL.RawPath)
+	decoded, err := url.PathUnescape(raw)
+	if err != nil {
+		r.URL.RawPath = (&url.URL{Path: prefix}).EscapedPath() + r.URL.RawPath
+		r.URL.Path = prefix + r.URL.Path
+		return
+	}
+	r.URL.Path, r.URL.RawPath = decoded, raw
+}
+
+// tidyPath applies PathCollapseSlashes and PathTrailingSlash to a
+// prefixed path.
+func (m Middleware) tidyPath(p string) string {
+	if m.PathCollapseSlashes {
+		for strings.Contains(p, "//") {
+			p = strings.ReplaceAll(p, "//", "/")
+		}
+	}
+	if m.PathTrailingSlash == trailingSlashStrip {
+		// paths start with a prefix other than "/", so one is left
+		p = strings.TrimRight(p, "/")
+	}
+
+	return p
+}
+
+// describeRecord adds the tokens of a cached record and their targets to
+// entry. Caddy placeholders in Domain are left as is, since they depend
+// on the request.
+func (m Middleware) describeRecord(record map[string]string, entry *cachedEntry) {
+	_, token, ok := m.token(record)
+	if !ok || token == "" {
+		return
+	}
+
+	tokens := []string{token}
+	if m.TokenSource == tokenSourceList || m.TokenSource == tokenSourceSet {
+		tokens = strings.Split(token, tokenSeparator)
+	}
+	for _, token := range tokens {
+		target, err := m.renderDomain(&http.Request{}, token, record)
+		if err != nil {
+			target = ""
+		}
+		entry.Tokens = append(entry.Tokens, token)
+		entry.Targets = append(entry.Targets, target)
+	}
+}
+
+// renderDomain replaces Caddy placeholders in Domain, then {{token}} with
+// token and every other {{field}} with that field of the record. Caddy
+// placeholders go first so values from Redis are never expanded.
+func (m Middleware) renderDomain(r *http.Request, token string, record map[string]string) (string, error) {
+	domain := m.Domain
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		domain = repl.ReplaceKnown(domain, "")
+	}
+
+	pairs := []string{tokenPlaceholder, token}
+	for _, field := range m.domainFields {
+		value, ok := record[field]
+		if !ok {
+			return "", fmt.Errorf("field %s of domain %q is missing", field, m.Domain)
+		}
+		pairs = append(pairs, "{{"+field+"}}", value)
+	}
+
+	return strings.NewReplacer(pairs...).Replace(domain), nil
+}
+
+// evict drops the cached records of host, for every method when the key
+// template has one.
+func (m Middleware) evict(host string) {
+	host = m.lookupHost(host)
+	m.records.delete(m.lookupKey(host, ""))
+	m.misses.delete(m.lookupKey(host, ""))
+	m.missingResponses.delete(host)
+	if !strings.Contains(m.KeyTemplate, methodPlaceholder) {
+		return
+	}
+
+	// render everything but the method, then match any method in between
+	before, after, _ := strings.Cut(m.lookupKey(host, methodPlaceholder), methodPlaceholder)
+	match := func(key string) bool {
+		return len(key) > len(before)+len(after) && strings.HasPrefix(key, before) && strings.HasSuffix(key, after)
+	}
+	m.records.deleteFunc(match)
+	m.misses.deleteFunc(match)
+}
+
+// matchedHost returns the name the request is routed by: its Host header,
+// or with match_on sni the server name of its TLS connection, if any.
+func (m Middleware) matchedHost(r *http.Request) string {
+	if m.MatchOn == matchOnSNI && r.TLS != nil && r.TLS.ServerName != "" {
+		return r.TLS.ServerName
+	}
+
+	return r.Host
+}
+
+// misdirected reports, with reject_misdirected, whether r came over a TLS
+// connection for another server name, which it returns.
+func (m Middleware) misdirected(r *http.Request) (string, bool) {
+	if !m.RejectMisdirected || r.TLS == nil || r.TLS.ServerName == "" {
+		return "", false
+	}
+
+	sni := r.TLS.ServerName
+	return sni, !sameHost(r.Host, sni)
+}
+
+// rejectMisdirected answers 421 to a request that came over a connection
+// for sni, so the client retries on a connection of its own.
+func (m Middleware) rejectMisdirected(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, sni string) error {
+	if m.DryRun {
+		m.decisions.Infow("Dry run, not rejecting misdirected request", "host", r.Host, "server_name", sni)
+		dynamicRoutingMetrics.dryRunRewrites.Inc()
+		return next.ServeHTTP(w, r)
+	}
+
+	m.decisions.Debugw("Rejecting misdirected request", "host", r.Host, "server_name", sni)
+	return caddyhttp.Error(http.StatusMisdirectedRequest, fmt.Errorf("host %s is not served on a connection for %s", r.Host, sni))
+}
+
+// lookupHost returns host as used in Redis keys, normalized unless
+// RawHost is set.
+func (m Middleware) lookupHost(host string) string {
+	if m.RawHost {
+		return host
+	}
+
+	return normalizeHost(host)
+}
+
+// lookupKey renders KeyTemplate for host, hashed by KeyHash, and method.
+// An empty method gives the default, method-less key.
+func (m Middleware) lookupKey(host, method string) string {
+	host = hashKeyName(m.KeyHash, host)
+	if m.KeyTemplate == "" || method == "" {
+		return fmt.Sprintf("%s:%s", m.Prefix, host)
+	}
+
+	return strings.NewReplacer(
+		prefixPlaceholder, m.Prefix,
+		hostPlaceholder, host,
+		methodPlaceholder, method,
+	).Replace(m.KeyTemplate)
+}
+
+// serveExistsOnly passes the request on if host has a key and denies it
+// otherwise, using EXISTS so no fields are read.
+func (m Middleware) serveExistsOnly(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, host string) error {
+	if !m.breaker.allow() {
+		countError(metricsModuleRouting, errorTypeRedis)
+		return lookupFailed(r.Host, caddyhttp.Error(http.StatusServiceUnavailable, errBreakerOpen))
+	}
+	if err := m.limiter.acquire(r.Context()); err != nil {
+		if isCanceled(err) {
+			return caddyhttp.Error(statusClientClosedRequest, err)
+		}
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+	keys := []string{m.lookupKey(host, r.Method)}
+	if strings.Contains(m.KeyTemplate, methodPlaceholder) {
+		keys = append(keys, m.lookupKey(host, ""))
+	}
+	// one key per EXISTS, as keys in different cluster slots can't be
+	// checked together
+	var n int64
+	var err error
+	done := m.ops.start()
+	ctx, cancel := m.lookupContext(r.Context())
+	for _, key := range keys {
+		start := time.Now()
+		err = m.replicas.read(m.redisClient, func(client redis.UniversalClient) (err error) {
+			n, err = client.Exists(ctx, key).Result()
+			return err
+		})
+		observeRedis(metricsModuleRouting, start)
+		if err != nil || n > 0 {
+			break
+		}
+	}
+	err = lookupTimedOut(r.Context(), ctx, err)
+	cancel()
+	done()
+	m.limiter.release()
+	m.breaker.record(err)
+	if isCanceled(err) {
+		return caddyhttp.Error(statusClientClosedRequest, err)
+	}
+	if err != nil {
+		countError(metricsModuleRouting, errorTypeRedis)
+		return lookupFailed(r.Host, err)
+	}
+
+	if n > 0 {
+		return next.ServeHTTP(w, r)
+	}
+	if m.DryRun {
+		m.decisions.Infow("Dry run, not denying host", "host", r.Host)
+		dynamicRoutingMetrics.dryRunRewrites.Inc()
+		return next.ServeHTTP(w, r)
+	}
+
+	status := m.DenyStatus
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	m.decisions.Debugw("Denying unknown host", "host", r.Host, "status", status)
+	return caddyhttp.Error(status, fmt.Errorf("unknown host: %s", r.Host))
+}
+
+func (m Middleware) debugStats() debugStats {
+	stats := debugStats{
+		Module:       metricsModuleRouting,
+		Prefix:       m.Prefix,
+		Lookups:      m.limiter.inFlight(),
+		DedupedKeys:  m.lookups.inFlight(),
+		CacheEntries: m.records.len(),
+		Pool:         m.redisClient.PoolStats(),
+		BreakerOpen:  m.breaker.isOpen(),
+	}
+	stats.setHealth(m.health)
+
+	return stats
+}
+
+// Cache results reported by fetch.
+const (
+	cacheHit         = "hit"
+	cacheNegativeHit = "negative_hit"
+	cacheMiss        = "miss"
+	cacheOff         = "off"
+	// cacheStale is an expired entry served while it is refreshed.
+	cacheStale = "stale"
+)
+
+// modeName returns Mode, or its default.
+func (m Middleware) modeName() string {
+	if m.Mode == "" {
+		return modeHost
+	}
+	return m.Mode
+}
+
+// fetch looks up the record at key, bounded by the request context ctx.
+// With dedupe_lookups, concurrent requests for the same key share a
+// single lookup and its result, so it isn't tied to any one request.
+// With stale_while_refresh, an expired record is returned at once and
+// refreshed in the background.
+func (m Middleware) fetch(ctx context.Context, key string) (map[string]string, string, error) {
+	cache := cacheOff
+	if m.records != nil {
+		record, ok := m.records.get(key)
+		countCacheLookup(metricsModuleRouting, ok)
+		if ok {
+			return record, cacheHit, nil
+		}
+		if record, ok := m.records.getStale(key); ok && m.StaleWhileRefresh {
+			m.refresh(key)
+			return record, cacheStale, nil
+		}
+		cache = cacheMiss
+	}
+	if m.misses != nil {
+		if _, ok := m.misses.get(key); ok {
+			return nil, cacheNegativeHit, nil
+		}
+		cache = cacheMiss
+	}
+
+	if m.lookups == nil {
+		// the lookup only serves this request, so it is bounded by ctx
+		// and a canceled one isn't stored
+		defer m.ops.start()()
+		record, err := m.lookup(ctx, key)
+		m.store(key, record, err)
+		return record, cache, err
+	}
+
+	// the shared lookup serves whichever requests join it, so it runs on
+	// m.background rather than the ctx of the one that started it. It may
+	// outlive them all, so it stores its result and counts as in flight
+	// until done.
+	done := m.ops.start()
+	record, err, shared := m.lookups.do(ctx, key, func() (map[string]string, error) {
+		defer done()
+		record, err := m.lookup(m.background, key)
+		m.store(key, record, err)
+		return record, err
+	})
+	if shared {
+		done()
+		m.decisions.Debugw("Shared in-flight lookup", "key", key)
+	}
+
+	return record, cache, err
+}
+
+// refresh looks key up again in the background, unless that is already
+// under way, for stale_while_refresh.
+func (m Middleware) refresh(key string) {
+	done := m.ops.start()
+	started := m.lookups.doBackground(key, func() (map[string]string, error) {
+		defer done()
+		record, err := m.lookup(m.background, key)
+		if err != nil {
+			// the stale record is served until Redis answers
+			m.decisions.Debugw("Refreshing stale record failed", "key", key, "error", err)
+		}
+		m.store(key, record, err)
+		return record, err
+	})
+	if !started {
+		done()
+		return
+	}
+	m.decisions.Debugw("Refreshing stale record", "key", key)
+}
+
+// store caches the result of looking up key, unless it failed.
+func (m Middleware) store(key string, record map[string]string, err error) {
+	switch {
+	case err != nil:
+	case len(record) == 0 && m.misses != nil:
+		// drop any stale record, which would otherwise be served first
+		m.records.delete(key)
+		m.misses.put(key, struct{}{})
+	default:
+		// hosts without a record are cached too, as they cost a lookup
+		// just the same
+		m.records.put(key, record)
+	}
+}
+
+// mergeQuery adds the configured query parameters to the request. New
+// pairs are appended to the raw query so existing parameters keep their
+// order and encoding.
+func (m Middleware) mergeQuery(r *http.Request, token string) {
+	existing := r.URL.Query()
+	names := make([]string, 0, len(m.Query))
+	for name := range m.Query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var added []string
+	for _, name := range names {
+		if existing.Has(name) && m.QueryMerge != "append" {
+			continue
+		}
+		value := strings.ReplaceAll(m.Query[name], tokenPlaceholder, token)
+		added = append(added, url.QueryEscape(name)+"="+url.QueryEscape(value))
+	}
+	if len(added) == 0 {
+		return
+	}
+
+	if r.URL.RawQuery != "" {
+		added = append([]string{r.URL.RawQuery}, added...)
+	}
+	r.URL.RawQuery = strings.Join(added, "&")
+}
+
+// lookup fetches the token and any configured optional fields of the hash
+// at key in one round trip. Fields missing from the hash are left out.
+func (m Middleware) lookup(ctx context.Context, key string) (map[string]string, error) {
+	if !m.breaker.allow() {
+		countError(metricsModuleRouting, errorTypeRedis)
+		return nil, caddyhttp.Error(http.StatusServiceUnavailable, errBreakerOpen)
+	}
+	if err := m.limiter.acquire(ctx); err != nil {
+		if isCanceled(err) {
+			return nil, err
+		}
+		return nil, caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+	defer m.limiter.release()
+
+	fields := append([]string{m.TokenKey}, m.TokenKeys...)
+	for _, field := range []string{m.TimeoutKey, m.CanonicalKey, m.PathKey} {
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	fields = append(fields, m.domainFields...)
+
+	lookupCtx, cancel := m.lookupContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+	var values []interface{}
+	var members []string
+	err := m.replicas.read(m.redisClient, func(client redis.UniversalClient) (err error) {
+		switch m.TokenSource {
+		case tokenSourceList:
+			members, err = client.LRange(lookupCtx, key, 0, -1).Result()
+		case tokenSourceSet:
+			// read whole so the record can be cached, then picked from
+			members, err = client.SMembers(lookupCtx, key).Result()
+		default:
+			values, err = client.HMGet(lookupCtx, key, fields...).Result()
+		}
+		return err
+	})
+	observeRedis(metricsModuleRouting, start)
+	err = lookupTimedOut(ctx, lookupCtx, err)
+	m.breaker.record(err)
+	if err != nil {
+		if !isCanceled(err) {
+			countError(metricsModuleRouting, errorTypeRedis)
+		}
+		return nil, err
+	}
+
+	if m.TokenSource == tokenSourceList || m.TokenSource == tokenSourceSet {
+		record := make(map[string]string, 1)
+		if tokens, ok := joinTokens(members); ok {
+			record[m.TokenKey] = tokens
+		}
+		return record, nil
+	}
+
+	record := make(map[string]string, len(fields))
+	for i, field := range fields {
+		if value, ok := values[i].(string); ok {
+			record[field] = value
+		}
+	}
+
+	return record, nil
+}
+
+// token returns the first non-empty token field of record, in the order
+// TokenKey, TokenKeys. If all present fields are empty the first of them
+// is returned with an empty token; ok is false when none is present.
+func (m Middleware) token(record map[string]string) (field, token string, ok bool) {
+	for _, name := range append([]string{m.TokenKey}, m.TokenKeys...) {
+		value, present := record[name]
+		if !present {
+			continue
+		}
+		if value != "" {
+			return name, value, true
+		}
+		if !ok {
+			field, ok = name, true
+		}
+	}
+
+	return field, "", ok
+}
+
+// lookupContext bounds a lookup under ctx by LookupTimeout, if set.
+func (m Middleware) lookupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.LookupTimeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, time.Duration(m.LookupTimeout))
+}
+
+// lookupTimedOut replaces err with errLookupTimeout when lookupCtx
+// expired while its parent ctx is still live, so it isn't mistaken for
+// a client that went away.
+func lookupTimedOut(ctx, lookupCtx context.Context, err error) error {
+	if err != nil && ctx.Err() == nil && errors.Is(lookupCtx.Err(), context.DeadlineExceeded) {
+		return errLookupTimeout
+	}
+
+	return err
+}
+
+// lookupFailed wraps a failed lookup of host in a LookupError, keeping
+// the status of errors that carry one.
+func lookupFailed(host string, err error) error {
+	if errors.Is(err, errLookupTimeout) {
+		return caddyhttp.Error(http.StatusGatewayTimeout, newLookupError(ErrRedisUnavailable, host, err))
+	}
+	if handlerErr, ok := err.(caddyhttp.HandlerError); ok {
+		return caddyhttp.Error(handlerErr.StatusCode, newLookupError(ErrRedisUnavailable, host, handlerErr.Err))
+	}
+
+	return newLookupError(ErrRedisUnavailable, host, err)
+}
+
+// setTimeoutVar stores the host's upstream timeout in the routing_timeout
+// var. Missing or malformed values are skipped.
+func (m Middleware) setTimeoutVar(r *http.Request, timeout string) {
+	if timeout == "" {
+		return
+	}
+
+	if _, err := caddy.ParseDuration(timeout); err != nil {
+		m.logger.Warnf("Invalid timeout %q for %s: %v", timeout, r.Host, err)
+		return
+	}
+
+	caddyhttp.SetVar(r.Context(), timeoutVar, timeout)
+}
+
+// redirectToCanonical redirects the request to the same URI on the canonical
+// host, keeping the request's port unless canonical has its own.
+func (m Middleware) redirectToCanonical(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, canonical string) error {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	status := m.CanonicalStatus
+	if status == 0 {
+		status = http.StatusMovedPermanently
+	}
+
+	// keep the port the client used unless the canonical host has one
+	if _, _, err := net.SplitHostPort(canonical); err != nil {
+		if _, port, err := net.SplitHostPort(r.Host); err == nil {
+			canonical = net.JoinHostPort(canonical, port)
+		}
+	}
+
+	target := scheme + "://" + canonical + r.URL.RequestURI()
+	if m.DryRun {
+		m.decisions.Infow("Dry run, not redirecting to canonical host", "from", r.Host, "to", target)
+		dynamicRoutingMetrics.dryRunRewrites.Inc()
+		return next.ServeHTTP(w, r)
+	}
+	m.decisions.Debugw("Redirecting to canonical host", "from", r.Host, "to", target)
+	http.Redirect(w, r, target, status)
+
+	return nil
+}
+
+// MissingResponse is what clients get for hosts without a token when
+// require_token is set: an error with Status for handle_errors, a
+// response with Status and Body, or a redirect to Redirect.
+type MissingResponse struct {
+	// Default 404, or 302 with Redirect.
+	Status int `json:"status,omitempty"`
+	// Body written as is instead of returning an error. Placeholders
+	// such as {http.request.host} are replaced.
+	Body string `json:"body,omitempty"`
+	// Content-Type of Body, default "text/html; charset=utf-8".
+	ContentType string `json:"content_type,omitempty"`
+	// URL to redirect to, with placeholders replaced.
+	Redirect string `json:"redirect,omitempty"`
+	// Keep the Body or Redirect rendered for a host for the block's
+	// NegativeCacheTTL, so repeated misses skip replacing placeholders.
+	// Only for placeholders that depend on nothing but the host.
+	Cache bool `json:"cache,omitempty"`
+}
+
+func (resp MissingResponse) validate() error {
+	switch {
+	case resp.Redirect != "" && resp.Body != "":
+		return fmt.Errorf("redirect and body can't be used together")
+	case resp.Redirect != "" && resp.Status != 0 && (resp.Status < 300 || resp.Status > 399):
+		return fmt.Errorf("invalid redirect status: %d", resp.Status)
+	case resp.Redirect == "" && resp.Status != 0 && (resp.Status < 200 || resp.Status > 599 || resp.Status/100 == 3):
+		return fmt.Errorf("invalid status: %d", resp.Status)
+	case resp.Cache && resp.Redirect == "" && resp.Body == "":
+		return fmt.Errorf("cache needs body or redirect")
+	}
+
+	return nil
+}
+
+// serveMissing answers a request for host, which has no token, as
+// configured by OnMissing.
+func (m Middleware) serveMissing(w http.ResponseWriter, r *http.Request, host string) error {
+	resp := MissingResponse{}
+	if m.OnMissing != nil {
+		resp = *m.OnMissing
+	}
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusNotFound
+		if resp.Redirect != "" {
+			status = http.StatusFound
+		}
+	}
+	replace := func(s string) string { return s }
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		replace = func(s string) string { return repl.ReplaceKnown(s, "") }
+	}
+	// only one of Redirect and Body is set, so a host has one rendering
+	render := func(s string) string {
+		if rendered, ok := m.missingResponses.get(host); ok {
+			return rendered
+		}
+		rendered := replace(s)
+		m.missingResponses.put(host, rendered)
+		return rendered
+	}
+
+	switch {
+	case resp.Redirect != "":
+		target := render(resp.Redirect)
+		m.decisions.Debugw("Redirecting host without token", "host", r.Host, "to", target)
+		http.Redirect(w, r, target, status)
+	case resp.Body != "":
+		m.decisions.Debugw("Answering host without token", "host", r.Host, "status", status)
+		contentType := resp.ContentType
+		if contentType == "" {
+			contentType = "text/html; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		// the status is sent, a failed write only means the client left
+		_, _ = w.Write([]byte(render(resp.Body)))
+	default:
+		return caddyhttp.Error(status, newLookupError(ErrHostNotFound, r.Host, redis.Nil))
+	}
+
+	return nil
+}
+
+// unmarshalMissingResponse parses the on_missing directive:
+//
+//	on_missing [<status>] {
+//		body <text>
+//		content_type <type>
+//		redirect <url>
+//		cache
+//	}
+func unmarshalMissingResponse(d *caddyfile.Dispenser) (*MissingResponse, error) {
+	resp := new(MissingResponse)
+	if d.NextArg() {
+		status, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return nil, d.Errf("invalid on_missing status: %s", d.Val())
+		}
+		resp.Status = status
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		field := d.Val()
+		if field == "cache" {
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			resp.Cache = true
+			continue
+		}
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch field {
+		case "body":
+			resp.Body = d.Val()
+		case "content_type":
+			resp.ContentType = d.Val()
+		case "redirect":
+			resp.Redirect = d.Val()
+		default:
+			return nil, d.Errf("Unknown on_missing field: %s", field)
+		}
+	}
+
+	if err := resp.validate(); err != nil {
+		return nil, d.Errf("on_missing: %v", err)
+	}
+
+	return resp, nil
+}
+
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
 func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	// default config
-	host := "127.0.0.1"
-	port := "6379"
-	db := 0
 	prefix := "s"
 	tokenKey := "token"
 
 	for d.Next() {
 		for d.NextBlock(0) {
-			switch d.Val() {
-			case "host":
-				if d.NextArg() {
-					host = d.Val()
-				}
-			case "port":
-				if d.NextArg() {
-					port = d.Val()
+			if handled, err := m.RedisConfig.unmarshalCaddyfileDirective(d); handled {
+				if err != nil {
+					return err
 				}
-			case "db":
-				if d.NextArg() {
-					parsedDb, err := strconv.Atoi(d.Val())
-					if err != nil {
-						return d.ArgErr()
-					}
-					db = parsedDb
+				continue
+			}
+
+			switch d.Val() {
+			case "fallback_redis":
+				config, err := unmarshalRedisFallback(d)
+				if err != nil {
+					return err
 				}
+				m.FallbackRedis = config
 			case "prefix":
 				if d.NextArg() {
 					prefix = d.Val()
@@ -107,16 +1397,299 @@ func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					tokenKey = d.Val()
 				}
 				m.TokenKey = tokenKey
+				m.TokenKeys = d.RemainingArgs()
+			case "token_source":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.TokenSource = d.Val()
+			case "max_concurrent_lookups":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				max, err := strconv.Atoi(d.Val())
+				if err != nil || max < 0 {
+					return d.Errf("invalid max_concurrent_lookups: %s", d.Val())
+				}
+				m.MaxConcurrentLookups = max
+			case "lookup_queue_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid lookup_queue_timeout: %v", err)
+				}
+				m.LookupQueueTimeout = caddy.Duration(timeout)
+			case "lookup_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(d.Val())
+				if err != nil || timeout <= 0 {
+					return d.Errf("invalid lookup_timeout: %s", d.Val())
+				}
+				m.LookupTimeout = caddy.Duration(timeout)
+			case "breaker_threshold":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				threshold, err := strconv.Atoi(d.Val())
+				if err != nil || threshold < 0 {
+					return d.Errf("invalid breaker_threshold: %s", d.Val())
+				}
+				m.BreakerThreshold = threshold
+			case "breaker_cooldown":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cooldown, err := caddy.ParseDuration(d.Val())
+				if err != nil || cooldown <= 0 {
+					return d.Errf("invalid breaker_cooldown: %s", d.Val())
+				}
+				m.BreakerCooldown = caddy.Duration(cooldown)
+			case "timeoutKey":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.TimeoutKey = d.Val()
+			case "path_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.PathKey = d.Val()
+			case "path_collapse_slashes":
+				m.PathCollapseSlashes = true
+			case "path_trailing_slash":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.PathTrailingSlash = d.Val()
+			case "canonicalKey":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.CanonicalKey = d.Val()
+			case "canonical_status":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				status, err := strconv.Atoi(d.Val())
+				if err != nil || status < 300 || status > 399 {
+					return d.Errf("invalid canonical_status: %s", d.Val())
+				}
+				m.CanonicalStatus = status
+			case "require_token":
+				m.RequireToken = true
+			case "on_missing":
+				resp, err := unmarshalMissingResponse(d)
+				if err != nil {
+					return err
+				}
+				m.OnMissing = resp
+			case "exists_only":
+				m.ExistsOnly = true
+				if d.NextArg() {
+					status, err := strconv.Atoi(d.Val())
+					if err != nil || status < 400 || status > 599 {
+						return d.Errf("invalid deny status: %s", d.Val())
+					}
+					m.DenyStatus = status
+				}
+			case "ip_hosts":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.IPHosts = d.Val()
+			case "verify_signature":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				m.SignatureKey, m.SignatureSecret = args[0], args[1]
+			case "raw_host":
+				m.RawHost = true
+			case "reject_misdirected":
+				m.RejectMisdirected = true
+			case "match_on":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.MatchOn = d.Val()
+			case "key_hash":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.KeyHash = d.Val()
+			case "validate_target":
+				m.ValidateTarget = true
+			case "debug_stats":
+				m.DebugStats = true
+			case "metrics_hosts":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.MetricsHosts = d.Val()
+				m.MetricsTrackedHosts = d.RemainingArgs()
+			case "decision_log_level":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.DecisionLogLevel = d.Val()
+			case "log_token":
+				m.LogToken = true
+			case "log_sample":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				sample, err := strconv.Atoi(d.Val())
+				if err != nil || sample < 0 {
+					return d.Errf("invalid log_sample: %s", d.Val())
+				}
+				m.LogSample = sample
+			case "tenant_counter":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				m.TenantCounter = args[0]
+				if len(args) == 2 {
+					window, err := caddy.ParseDuration(args[1])
+					if err != nil {
+						return d.Errf("invalid tenant window: %v", err)
+					}
+					m.TenantWindow = caddy.Duration(window)
+				}
+			case "tenant_counter_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.TenantCounterKey = d.Val()
+			case "empty_token":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.EmptyToken = d.Val()
+			case "query":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if m.Query == nil {
+					m.Query = make(map[string]string)
+				}
+				m.Query[args[0]] = args[1]
+			case "mode":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Mode = d.Val()
+			case "key_template":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.KeyTemplate = d.Val()
+			case "forwarded_headers":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ForwardedHeaders = d.Val()
+			case "via":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Via = d.Val()
+			case "query_merge":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.QueryMerge = d.Val()
+			case "self_test":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.SelfTestKey = d.Val()
+			case "static_target":
+				m.StaticTarget = true
+			case "dry_run":
+				m.DryRun = true
+			case "cache_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
+				if err != nil || ttl < 0 {
+					return d.Errf("invalid cache_ttl: %s", d.Val())
+				}
+				m.CacheTTL = caddy.Duration(ttl)
+			case "negative_cache_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
+				if err != nil || ttl <= 0 {
+					return d.Errf("invalid negative_cache_ttl: %s", d.Val())
+				}
+				m.NegativeCacheTTL = caddy.Duration(ttl)
+			case "cache_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(d.Val())
+				if err != nil || size <= 0 {
+					return d.Errf("invalid cache_size: %s", d.Val())
+				}
+				m.CacheSize = size
+			case "ping_on_start":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ping, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid ping_on_start: %s", d.Val())
+				}
+				m.PingOnStart = &ping
+			case "invalidate_channel":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.InvalidateChannel = d.Val()
+			case "dedupe_lookups":
+				m.DedupeLookups = true
+			case "stale_while_refresh":
+				m.StaleWhileRefresh = true
+			case "max_host_length":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				max, err := strconv.Atoi(args[0])
+				if err != nil || max <= 0 {
+					return d.Errf("invalid max_host_length: %s", args[0])
+				}
+				m.MaxHostLength = max
+				if len(args) == 2 {
+					m.LongHost = args[1]
+				}
+			case "credentials":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.CredentialsSource = d.Val()
+			case "codecs":
+				m.Codecs = d.RemainingArgs()
+				if len(m.Codecs) == 0 {
+					return d.ArgErr()
+				}
 			default:
 				return d.Errf("Unknown field: %s", d.Val())
 			}
 		}
 	}
 
-	// prepare options for new redis
-	m.redisOptions = redis.Options{
-		Addr: strings.Join([]string{host, port}, ":"),
-		DB:   db,
+	// catch conflicting settings and unreadable TLS files early
+	if _, _, err := m.RedisConfig.options(); err != nil {
+		return d.Err(err.Error())
 	}
 
 	return nil
@@ -132,7 +1705,18 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 // Cleanup frees up resources allocated during Provision.
 func (m *Middleware) Cleanup() error {
 	m.logger.Debug("Cleaning up routing redis")
-	err := m.redisClient.Close()
+	if n := m.ops.drain(drainTimeout); n > 0 {
+		m.logger.Warnf("Releasing Redis with %d lookups still running after %s", n, drainTimeout)
+	}
+	if m.cancel != nil {
+		m.cancel()
+	}
+	unregisterDebugSource(m)
+	unregisterCacheSource(m)
+	if err := m.replicas.release(); err != nil {
+		return err
+	}
+	err := releaseRedisClient(m.redisClient, m.redisKey)
 	if err != nil {
 		return err
 	}
@@ -143,6 +1727,7 @@ func (m *Middleware) Cleanup() error {
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Middleware)(nil)
+	_ caddy.Validator             = (*Middleware)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
 	_ caddyfile.Unmarshaler       = (*Middleware)(nil)
 )
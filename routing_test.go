@@ -0,0 +1,425 @@
+package guard
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// newTestMiddleware returns a Middleware routing hosts by the token field
+// of routing:<host> in client to <token>.internal, set up as far as
+// ServeHTTP needs without Provision.
+func newTestMiddleware(t *testing.T, client *fakeRedis) *Middleware {
+	t.Helper()
+
+	ensureMetrics()
+	hostLength, err := newHostLengthPolicy(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	background, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	return &Middleware{
+		Prefix:      "routing",
+		TokenKey:    "token",
+		Domain:      "{{token}}.internal",
+		hostLength:  hostLength,
+		ops:         new(inFlightOps),
+		background:  background,
+		cancel:      cancel,
+		redisClient: client.Client,
+		logger:      zap.NewNop().Sugar(),
+		decisions:   zap.NewNop().Sugar(),
+	}
+}
+
+// serveTest passes r through m and returns the host the next handler saw,
+// empty if it wasn't called.
+func serveTest(m *Middleware, r *http.Request) (string, error) {
+	var host string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		host = r.Host
+		return nil
+	})
+	err := m.ServeHTTP(httptest.NewRecorder(), r, next)
+
+	return host, err
+}
+
+func TestPrefixPath(t *testing.T) {
+	tests := []struct {
+		name          string
+		target        string
+		prefix        string
+		collapse      bool
+		trailingSlash string
+		wantPath      string
+		wantEscaped   string
+	}{
+		{name: "root path", target: "/", prefix: "/tenants/acme", wantPath: "/tenants/acme/", wantEscaped: "/tenants/acme/"},
+		{name: "root path stripped", target: "/", prefix: "/tenants/acme", trailingSlash: trailingSlashStrip, wantPath: "/tenants/acme", wantEscaped: "/tenants/acme"},
+		{name: "unclean prefix", target: "/api", prefix: "tenants/acme/", wantPath: "/tenants/acme/api", wantEscaped: "/tenants/acme/api"},
+		{name: "prefix can't climb", target: "/api", prefix: "../../etc", wantPath: "/etc/api", wantEscaped: "/etc/api"},
+		{name: "root prefix", target: "//api/", prefix: "/", collapse: true, trailingSlash: trailingSlashStrip, wantPath: "//api/", wantEscaped: "//api/"},
+		{name: "trailing slash kept", target: "/api/", prefix: "/t", wantPath: "/t/api/", wantEscaped: "/t/api/"},
+		{name: "trailing slash stripped", target: "/api/", prefix: "/t", trailingSlash: trailingSlashStrip, wantPath: "/t/api", wantEscaped: "/t/api"},
+		{name: "trailing slashes stripped", target: "/api///", prefix: "/t", trailingSlash: trailingSlashStrip, wantPath: "/t/api", wantEscaped: "/t/api"},
+		{name: "slashes kept", target: "//api//users", prefix: "/t", wantPath: "/t//api//users", wantEscaped: "/t//api//users"},
+		{name: "slashes collapsed", target: "//api//users", prefix: "/t", collapse: true, wantPath: "/t/api/users", wantEscaped: "/t/api/users"},
+		{name: "encoded slash kept", target: "/files/a%2Fb", prefix: "/t", collapse: true, trailingSlash: trailingSlashStrip, wantPath: "/t/files/a/b", wantEscaped: "/t/files/a%2Fb"},
+		{name: "encoded slash next to separator", target: "/a%2F//b/", prefix: "/t", collapse: true, trailingSlash: trailingSlashStrip, wantPath: "/t/a//b", wantEscaped: "/t/a%2F/b"},
+		{name: "encoded trailing slash", target: "/a%2F", prefix: "/t", trailingSlash: trailingSlashStrip, wantPath: "/t/a/", wantEscaped: "/t/a%2F"},
+		{name: "escaped prefix", target: "/a%2Fb", prefix: "/with space", wantPath: "/with space/a/b", wantEscaped: "/with%20space/a%2Fb"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Middleware{
+				PathCollapseSlashes: tt.collapse,
+				PathTrailingSlash:   tt.trailingSlash,
+				decisions:           zap.NewNop().Sugar(),
+			}
+			r := httptest.NewRequest("GET", "http://example.com"+tt.target+"?page=2", nil)
+
+			m.prefixPath(r, tt.prefix)
+
+			if r.URL.Path != tt.wantPath {
+				t.Errorf("Path = %q, want %q", r.URL.Path, tt.wantPath)
+			}
+			if got := r.URL.EscapedPath(); got != tt.wantEscaped {
+				t.Errorf("EscapedPath() = %q, want %q", got, tt.wantEscaped)
+			}
+			if r.URL.RawQuery != "page=2" {
+				t.Errorf("RawQuery = %q, want %q", r.URL.RawQuery, "page=2")
+			}
+		})
+	}
+}
+
+func TestSharedClientKeepsPrefixes(t *testing.T) {
+	// modules on one client only share its commands, keys are their own
+	client := newFakeRedis(map[string]map[string]string{
+		"routing:example.com": {"token": "a"},
+		"tenants:example.com": {"token": "b"},
+		"certs:example.com":   {"cert": testPEMBundle(t, "example.com")},
+	})
+	routing := newTestMiddleware(t, client)
+	tenants := newTestMiddleware(t, client)
+	tenants.Prefix = "tenants"
+	certs := newTestCertGetter(t, client)
+
+	for _, tt := range []struct {
+		m    *Middleware
+		want string
+	}{
+		{m: routing, want: "a.internal"},
+		{m: tenants, want: "b.internal"},
+	} {
+		host, err := serveTest(tt.m, httptest.NewRequest("GET", "http://example.com/", nil))
+		if err != nil {
+			t.Fatalf("prefix %s: ServeHTTP() error = %v", tt.m.Prefix, err)
+		}
+		if host != tt.want {
+			t.Errorf("prefix %s: routed to %q, want %q", tt.m.Prefix, host, tt.want)
+		}
+	}
+	if cert, err := certs.GetCertificate(context.Background(), &tls.ClientHelloInfo{ServerName: "example.com"}); err != nil || cert == nil {
+		t.Errorf("prefix %s: GetCertificate() = %v, %v, want a certificate", certs.Prefix, cert, err)
+	}
+
+	want := []string{"routing:example.com", "tenants:example.com", "certs:example.com"}
+	if got := client.commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("keys read = %q, want %q", got, want)
+	}
+}
+
+func TestMiddlewareSelfTest(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   map[string]string
+		redisErr error
+		wantErr  bool
+	}{
+		{name: "token", record: map[string]string{"token": "a"}},
+		{name: "missing record", wantErr: true},
+		{name: "missing field", record: map[string]string{"other": "a"}, wantErr: true},
+		{name: "empty token", record: map[string]string{"token": ""}, wantErr: true},
+		{name: "redis down", redisErr: errors.New("connection refused"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeRedis(map[string]map[string]string{})
+			if tt.record != nil {
+				client.hashes["health:ping"] = tt.record
+			}
+			client.err = tt.redisErr
+			m := newTestMiddleware(t, client)
+			m.SelfTestKey = "health:ping"
+
+			err := m.selfTest(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selfTest() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "health:ping") {
+				t.Errorf("selfTest() error %q doesn't name the sentinel key", err)
+			}
+		})
+	}
+}
+
+func TestServeHTTPCanceled(t *testing.T) {
+	for _, dedupe := range []bool{false, true} {
+		client := newFakeRedis(map[string]map[string]string{})
+		client.block = true
+		m := newTestMiddleware(t, client)
+		m.breaker = newCircuitBreaker(1, 0, m.logger)
+		if dedupe {
+			m.DedupeLookups, m.lookups = true, new(lookupGroup)
+		}
+		redisErrors := dynamicRoutingMetrics.errors.WithLabelValues(metricsModuleRouting, errorTypeRedis)
+		before := testutil.ToFloat64(redisErrors)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		r := httptest.NewRequest("GET", "http://example.com/", nil).WithContext(ctx)
+		host, err := serveTest(m, r)
+
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != statusClientClosedRequest || !errors.Is(err, context.Canceled) {
+			t.Errorf("dedupe %v: ServeHTTP() error = %v, want %d with context.Canceled", dedupe, err, statusClientClosedRequest)
+		}
+		if host != "" {
+			t.Errorf("dedupe %v: canceled request passed on to %q", dedupe, host)
+		}
+		if errors.Is(err, ErrRedisUnavailable) {
+			t.Errorf("dedupe %v: canceled lookup reported as Redis unavailable", dedupe)
+		}
+		if m.breaker.isOpen() {
+			t.Errorf("dedupe %v: canceled lookup opened the circuit breaker", dedupe)
+		}
+		if got := testutil.ToFloat64(redisErrors); got != before {
+			t.Errorf("dedupe %v: redis errors counted = %v, want 0", dedupe, got-before)
+		}
+	}
+}
+
+func TestServeHTTPValidateTarget(t *testing.T) {
+	tests := []struct {
+		token      string
+		wantHost   string
+		wantStatus int
+	}{
+		{token: "a", wantHost: "a.internal"},
+		{token: "Tenant-A", wantHost: "tenant-a.internal"},
+		{token: "bad token", wantStatus: http.StatusBadGateway},
+		{token: "a/b", wantStatus: http.StatusBadGateway},
+		{token: "-a", wantStatus: http.StatusBadGateway},
+		{token: "a..b", wantStatus: http.StatusBadGateway},
+		{token: "\xff\xfe", wantStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		m := newTestMiddleware(t, newFakeRedis(map[string]map[string]string{
+			"routing:example.com": {"token": tt.token},
+		}))
+		m.ValidateTarget = true
+
+		host, err := serveTest(m, httptest.NewRequest("GET", "http://example.com/", nil))
+
+		if tt.wantStatus == 0 {
+			if err != nil || host != tt.wantHost {
+				t.Errorf("token %q: routed to %q, %v, want %q", tt.token, host, err, tt.wantHost)
+			}
+			continue
+		}
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.StatusCode != tt.wantStatus || !errors.Is(err, errInvalidTarget) {
+			t.Errorf("token %q: ServeHTTP() error = %v, want %d with errInvalidTarget", tt.token, err, tt.wantStatus)
+		}
+		if host != "" {
+			t.Errorf("token %q: passed on to %q", tt.token, host)
+		}
+	}
+}
+
+// requestKey marks contexts derived from a request's.
+type requestKey struct{}
+
+func TestServeHTTPLookupContext(t *testing.T) {
+	tests := []struct {
+		name           string
+		dedupe         bool
+		existsOnly     bool
+		lookupTimeout  time.Duration
+		wantBackground bool
+	}{
+		{name: "lookup", wantBackground: false},
+		{name: "lookup with timeout", lookupTimeout: time.Second, wantBackground: false},
+		{name: "exists only", existsOnly: true, wantBackground: false},
+		{name: "shared lookup", dedupe: true, wantBackground: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeRedis(map[string]map[string]string{
+				"routing:example.com": {"token": "a"},
+			})
+			m := newTestMiddleware(t, client)
+			m.ExistsOnly = tt.existsOnly
+			m.LookupTimeout = caddy.Duration(tt.lookupTimeout)
+			if tt.dedupe {
+				m.DedupeLookups, m.lookups = true, new(lookupGroup)
+			}
+
+			r := httptest.NewRequest("GET", "http://example.com/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), requestKey{}, true))
+			if _, err := serveTest(m, r); err != nil {
+				t.Fatalf("ServeHTTP() error = %v", err)
+			}
+
+			ctxs := client.contexts()
+			if len(ctxs) != 1 {
+				t.Fatalf("Redis commands = %d, want 1", len(ctxs))
+			}
+			if fromRequest := ctxs[0].Value(requestKey{}) != nil; fromRequest == tt.wantBackground {
+				t.Fatalf("lookup bound to the request context = %v, want %v", fromRequest, !tt.wantBackground)
+			}
+			if !tt.wantBackground {
+				return
+			}
+			if err := m.Cleanup(); err != nil {
+				t.Fatal(err)
+			}
+			if ctxs[0].Err() == nil {
+				t.Error("shared lookup context outlives Cleanup")
+			}
+		})
+	}
+}
+
+func TestServeHTTPCacheExpiry(t *testing.T) {
+	client := newFakeRedis(map[string]map[string]string{
+		"routing:example.com": {"token": "a"},
+	})
+	m := newTestMiddleware(t, client)
+	m.records = newTTLCache[map[string]string](50*time.Millisecond, 0)
+	m.misses = newTTLCache[struct{}](50*time.Millisecond, 0)
+
+	steps := []struct {
+		name         string
+		host         string
+		sleep        time.Duration
+		token        string
+		wantHost     string
+		wantCommands int
+	}{
+		{name: "first request", host: "example.com", wantHost: "a.internal", wantCommands: 1},
+		{name: "cached", host: "example.com", wantHost: "a.internal", wantCommands: 1},
+		{name: "record changed, still cached", host: "example.com", token: "b", wantHost: "a.internal", wantCommands: 1},
+		{name: "expired", host: "example.com", sleep: 60 * time.Millisecond, wantHost: "b.internal", wantCommands: 2},
+		{name: "unknown host", host: "other.com", wantHost: "other.com", wantCommands: 3},
+		{name: "unknown host cached", host: "other.com", wantHost: "other.com", wantCommands: 3},
+		{name: "unknown host expired", host: "other.com", sleep: 60 * time.Millisecond, wantHost: "other.com", wantCommands: 4},
+	}
+
+	for _, step := range steps {
+		if step.token != "" {
+			client.mu.Lock()
+			client.hashes["routing:example.com"]["token"] = step.token
+			client.mu.Unlock()
+		}
+		time.Sleep(step.sleep)
+
+		host, err := serveTest(m, httptest.NewRequest("GET", "http://"+step.host+"/", nil))
+		if err != nil || host != step.wantHost {
+			t.Errorf("%s: routed to %q, %v, want %q", step.name, host, err, step.wantHost)
+		}
+		if got := len(client.commands()); got != step.wantCommands {
+			t.Errorf("%s: Redis commands = %d, want %d", step.name, got, step.wantCommands)
+		}
+	}
+}
+
+func TestServeHTTPMissingResponseCache(t *testing.T) {
+	m := newTestMiddleware(t, newFakeRedis(nil))
+	m.RequireToken = true
+	m.OnMissing = &MissingResponse{Body: "{test.host} is not a tenant", Cache: true}
+	m.missingResponses = newTTLCache[string](50*time.Millisecond, 0)
+
+	steps := []struct {
+		name     string
+		host     string
+		body     string
+		sleep    time.Duration
+		wantBody string
+	}{
+		{name: "first miss", host: "example.com", wantBody: "example.com is not a tenant"},
+		{name: "body changed, still cached", host: "example.com", body: "{test.host} is unknown", wantBody: "example.com is not a tenant"},
+		{name: "other host", host: "other.com", wantBody: "other.com is unknown"},
+		{name: "expired", host: "example.com", sleep: 60 * time.Millisecond, wantBody: "example.com is unknown"},
+	}
+
+	for _, step := range steps {
+		if step.body != "" {
+			m.OnMissing.Body = step.body
+		}
+		time.Sleep(step.sleep)
+
+		r := httptest.NewRequest("GET", "http://"+step.host+"/", nil)
+		repl := caddy.NewReplacer()
+		repl.Set("test.host", step.host)
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+		w := httptest.NewRecorder()
+		if err := m.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })); err != nil {
+			t.Fatalf("%s: ServeHTTP() error = %v", step.name, err)
+		}
+		if w.Code != http.StatusNotFound || w.Body.String() != step.wantBody {
+			t.Errorf("%s: answered %d %q, want 404 %q", step.name, w.Code, w.Body.String(), step.wantBody)
+		}
+	}
+}
+
+func TestChainedPrefixes(t *testing.T) {
+	client := newFakeRedis(map[string]map[string]string{
+		"eu:shop.example.com":      {"token": "eu-shop"},
+		"routing:shop.example.com": {"token": "shop"},
+		"routing:blog.example.com": {"token": "blog"},
+	})
+	regional, global := newTestMiddleware(t, client), newTestMiddleware(t, client)
+	regional.Prefix = "eu"
+
+	tests := []struct {
+		host     string
+		wantHost string
+	}{
+		{host: "shop.example.com", wantHost: "eu-shop.internal"},
+		{host: "blog.example.com", wantHost: "blog.internal"},
+		{host: "other.example.com", wantHost: "other.example.com"},
+	}
+
+	for _, tt := range tests {
+		var host string
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return global.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				host = r.Host
+				return nil
+			}))
+		})
+		if err := regional.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://"+tt.host+"/", nil), next); err != nil || host != tt.wantHost {
+			t.Errorf("%s: routed to %q, %v, want %q", tt.host, host, err, tt.wantHost)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package guard
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// errBadSignature is returned when a token's signature doesn't verify.
+var errBadSignature = errors.New("token signature mismatch")
+
+// verifyTokenSignature checks that signature is the hex encoded
+// HMAC-SHA256 of token under secret.
+func verifyTokenSignature(secret []byte, token, signature string) error {
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return errBadSignature
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(token))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errBadSignature
+	}
+
+	return nil
+}
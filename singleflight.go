@@ -0,0 +1,109 @@
+package guard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// errLookupPanicked is returned to the callers of a lookup that panicked.
+var errLookupPanicked = errors.New("shared redis lookup panicked")
+
+// lookupCall is an in-flight or completed lookupGroup call.
+type lookupCall struct {
+	// done is closed once val and err are set.
+	done chan struct{}
+	val  map[string]string
+	err  error
+}
+
+// lookupGroup deduplicates concurrent lookups of the same key, in the
+// manner of golang.org/x/sync/singleflight. The zero value is ready to use.
+type lookupGroup struct {
+	mu    sync.Mutex
+	calls map[string]*lookupCall
+}
+
+// do runs fn once for all concurrent callers with the same key. Callers
+// share the returned record and must not modify it. fn runs in its own
+// goroutine, so every caller, the first included, gives up when its ctx is
+// done while fn carries on for the others. shared reports whether the
+// result came from another caller's lookup.
+func (g *lookupGroup) do(ctx context.Context, key string, fn func() (map[string]string, error)) (val map[string]string, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*lookupCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.val, c.err, true
+		case <-ctx.Done():
+			return nil, ctx.Err(), true
+		}
+	}
+	c := g.start(key)
+	g.mu.Unlock()
+
+	go g.run(key, c, fn)
+	select {
+	case <-c.done:
+		return c.val, c.err, false
+	case <-ctx.Done():
+		return nil, ctx.Err(), false
+	}
+}
+
+// doBackground runs fn for key in a new goroutine, unless a lookup of key
+// is already in flight. It reports whether it started one.
+func (g *lookupGroup) doBackground(key string, fn func() (map[string]string, error)) bool {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*lookupCall)
+	}
+	if _, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		return false
+	}
+	c := g.start(key)
+	g.mu.Unlock()
+
+	go g.run(key, c, fn)
+	return true
+}
+
+// start registers a call for key. g.mu must be held.
+func (g *lookupGroup) start(key string) *lookupCall {
+	c := &lookupCall{done: make(chan struct{})}
+	g.calls[key] = c
+	return c
+}
+
+// run calls fn for c and releases its waiters. A panic in fn is recovered,
+// as nothing up the goroutine's stack would, and they get errLookupPanicked.
+func (g *lookupGroup) run(key string, c *lookupCall, fn func() (map[string]string, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.val, c.err = nil, fmt.Errorf("%w: %v", errLookupPanicked, r)
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.val, c.err = fn()
+}
+
+// inFlight returns the number of keys with a lookup in flight.
+func (g *lookupGroup) inFlight() int {
+	if g == nil {
+		return 0
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.calls)
+}
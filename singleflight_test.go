@@ -0,0 +1,59 @@
+package guard
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLookupGroupCanceled(t *testing.T) {
+	var g lookupGroup
+	release := make(chan struct{})
+	calls := 0
+	lookup := func() (map[string]string, error) {
+		calls++
+		<-release
+		return map[string]string{"token": "a"}, nil
+	}
+
+	// the first caller gives up, the lookup carries on for the next one
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err, shared := g.do(ctx, "key", lookup); !errors.Is(err, context.Canceled) || shared {
+		t.Fatalf("do() with canceled context = %v, shared %v, want context.Canceled", err, shared)
+	}
+	if g.inFlight() != 1 {
+		t.Fatalf("inFlight() = %d after the first caller gave up, want 1", g.inFlight())
+	}
+
+	// a waiter gives up too
+	if _, err, shared := g.do(ctx, "key", lookup); !errors.Is(err, context.Canceled) || !shared {
+		t.Fatalf("waiting do() with canceled context = %v, shared %v, want context.Canceled", err, shared)
+	}
+
+	time.AfterFunc(10*time.Millisecond, func() { close(release) })
+	if val, err, shared := g.do(context.Background(), "key", lookup); err != nil || !shared || val["token"] != "a" {
+		t.Errorf("waiting do() = %v, %v, shared %v, want the shared record", val, err, shared)
+	}
+	if calls != 1 {
+		t.Errorf("lookup ran %d times, want 1", calls)
+	}
+	if g.inFlight() != 0 {
+		t.Errorf("inFlight() = %d after the lookup finished, want 0", g.inFlight())
+	}
+}
+
+func TestLookupGroupPanic(t *testing.T) {
+	var g lookupGroup
+
+	_, err, _ := g.do(context.Background(), "key", func() (map[string]string, error) {
+		panic("boom")
+	})
+	if !errors.Is(err, errLookupPanicked) {
+		t.Errorf("do() error = %v, want errLookupPanicked", err)
+	}
+	if g.inFlight() != 0 {
+		t.Errorf("inFlight() = %d after the panic, want 0", g.inFlight())
+	}
+}
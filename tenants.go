@@ -0,0 +1,170 @@
+package guard
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// maxTrackedTenants bounds the in-memory tenant set. Once reached, new
+// hosts are not counted until the window rolls over.
+const maxTrackedTenants = 100000
+
+const (
+	// tenantQueueSize bounds the hosts waiting for the hll worker; more
+	// are dropped, which only lowers the estimate under extreme load.
+	tenantQueueSize = 4096
+	// tenantBatchSize and tenantFlushInterval bound how many hosts the
+	// hll worker collects, and for how long, before one PFADD.
+	tenantBatchSize     = 512
+	tenantFlushInterval = time.Second
+)
+
+// tenantCounter estimates the number of distinct hosts routed within a
+// window and publishes it as the tenants_seen metric.
+type tenantCounter interface {
+	observe(host string)
+}
+
+func newTenantCounter(ctx context.Context, kind string, window time.Duration, client redis.UniversalClient, key string, logger *zap.SugaredLogger) (tenantCounter, error) {
+	if window <= 0 {
+		window = time.Hour
+	}
+
+	switch kind {
+	case "":
+		return nil, nil
+	case "memory":
+		return &memoryTenantCounter{window: window}, nil
+	case "hll":
+		c := &hllTenantCounter{
+			ctx:    ctx,
+			client: client,
+			key:    key,
+			window: window,
+			hosts:  make(chan string, tenantQueueSize),
+			logger: logger,
+		}
+		go c.run()
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unknown tenant_counter: %s", kind)
+	}
+}
+
+// memoryTenantCounter keeps an exact, bounded set of hosts per window.
+type memoryTenantCounter struct {
+	mu          sync.Mutex
+	seen        map[string]struct{}
+	window      time.Duration
+	windowStart time.Time
+}
+
+func (c *memoryTenantCounter) observe(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := time.Now(); c.seen == nil || now.Sub(c.windowStart) >= c.window {
+		c.seen = make(map[string]struct{})
+		c.windowStart = now
+		dynamicRoutingMetrics.tenantsSeen.Set(0)
+	}
+	if _, ok := c.seen[host]; ok || len(c.seen) >= maxTrackedTenants {
+		return
+	}
+	c.seen[host] = struct{}{}
+
+	dynamicRoutingMetrics.tenantsSeen.Set(float64(len(c.seen)))
+}
+
+// hllTenantCounter adds hosts to a HyperLogLog in Redis, one key per
+// window, so the estimate is shared by every Caddy instance. Hosts are
+// queued and added in batches by a single worker until ctx is done.
+type hllTenantCounter struct {
+	ctx    context.Context
+	client redis.UniversalClient
+	key    string
+	window time.Duration
+	hosts  chan string
+	logger *zap.SugaredLogger
+	// lastKey is the window key of the last flush, only used by run.
+	lastKey string
+}
+
+// observe queues host without blocking the request, dropping it when the
+// queue is full.
+func (c *hllTenantCounter) observe(host string) {
+	select {
+	case c.hosts <- host:
+	default:
+	}
+}
+
+// run collects queued hosts and flushes them once tenantBatchSize are
+// distinct or tenantFlushInterval has passed.
+func (c *hllTenantCounter) run() {
+	ticker := time.NewTicker(tenantFlushInterval)
+	defer ticker.Stop()
+
+	batch := make(map[string]struct{})
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case host := <-c.hosts:
+			batch[host] = struct{}{}
+			if len(batch) < tenantBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		c.flush(batch)
+		batch = make(map[string]struct{})
+	}
+}
+
+// flush adds batch to the current window's HyperLogLog and publishes the
+// new estimate.
+func (c *hllTenantCounter) flush(batch map[string]struct{}) {
+	windowStart := time.Now().Truncate(c.window)
+	key := fmt.Sprintf("%s:%d", c.key, windowStart.Unix())
+
+	hosts := make([]interface{}, 0, len(batch))
+	for host := range batch {
+		hosts = append(hosts, host)
+	}
+
+	pipe := c.client.TxPipeline()
+	added := pipe.PFAdd(c.ctx, key, hosts...)
+	pipe.Expire(c.ctx, key, 2*c.window)
+	if _, err := pipe.Exec(c.ctx); err != nil {
+		if !isCanceled(err) {
+			c.logger.Warnf("Counting %d tenants: %v", len(hosts), err)
+		}
+		return
+	}
+
+	// the estimate only changes when the register was updated, or when
+	// this is the first flush into a window other instances may have
+	// filled already
+	newWindow := key != c.lastKey
+	c.lastKey = key
+	if added.Val() == 0 && !newWindow {
+		return
+	}
+	count, err := c.client.PFCount(c.ctx, key).Result()
+	if err != nil {
+		if !isCanceled(err) {
+			c.logger.Warnf("Counting tenants: %v", err)
+		}
+		return
+	}
+	dynamicRoutingMetrics.tenantsSeen.Set(float64(count))
+}
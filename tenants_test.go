@@ -0,0 +1,33 @@
+package guard
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMemoryTenantCounterWindow(t *testing.T) {
+	ensureMetrics()
+	c := &memoryTenantCounter{window: 50 * time.Millisecond}
+
+	steps := []struct {
+		name  string
+		hosts []string
+		sleep time.Duration
+		want  float64
+	}{
+		{name: "first window", hosts: []string{"a.example.com", "b.example.com", "a.example.com"}, want: 2},
+		{name: "next window", hosts: []string{"a.example.com"}, sleep: 60 * time.Millisecond, want: 1},
+	}
+
+	for _, step := range steps {
+		time.Sleep(step.sleep)
+		for _, host := range step.hosts {
+			c.observe(host)
+		}
+		if got := testutil.ToFloat64(dynamicRoutingMetrics.tenantsSeen); got != step.want {
+			t.Errorf("%s: tenants seen = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
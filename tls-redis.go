@@ -4,27 +4,253 @@ package guard
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"encoding/pem"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/certmagic"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
+// errEmptyCert is returned when cert fields exist but are empty.
+var errEmptyCert = errors.New("cert field is empty")
+
+// errMissingKey is returned when KeyKey is set but the key field is
+// missing or empty while a cert field is present.
+var errMissingKey = errors.New("private key field is missing")
+
+// errExpiredCert is returned with reject_expired when no certificate is
+// currently valid.
+var errExpiredCert = errors.New("certificate expired")
+
+// defaultExpiryWarn is the default expiry_warn window.
+const defaultExpiryWarn = 7 * 24 * time.Hour
+
+// defaultMaxCertSize is the default max_cert_size, in bytes.
+const defaultMaxCertSize = 256 << 10
+
+// errCertTooLarge is returned for values over max_cert_size.
+var errCertTooLarge = errors.New("value exceeds max_cert_size")
+
+// errNotPEM is returned for values, e.g. raw binary data, without PEM blocks.
+var errNotPEM = errors.New("value is not PEM encoded, use format der or a codec such as base64 or gzip for binary values")
+
+// Values of Compression; the default detects gzip.
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+)
+
+// Policies for OnMiss and OnError.
+const (
+	policyError   = "error"
+	policyDecline = "decline"
+)
+
+// sniPlaceholder is replaced with the server name in KeyTemplate, as is
+// {{host}}.
+const sniPlaceholder = "{{sni}}"
+
+// acmeTLS1Protocol is the ALPN protocol negotiated by TLS-ALPN-01 challenges.
+const acmeTLS1Protocol = "acme-tls/1"
+
 type RedisCertGetter struct {
+	// Redis connection settings, inlined in the JSON config.
+	RedisConfig
+	// Secondary Redis for reads that fail on the primary.
+	FallbackRedis *RedisConfig `json:"fallback_redis,omitempty"`
+
 	Prefix  string `json:"prefix,omitempty"`
 	CertKey string `json:"certKey,omitempty"`
+	// Warn when the served certificate expires within this window,
+	// default 7 days. Negative disables the warning.
+	ExpiryWarn caddy.Duration `json:"expiry_warn,omitempty"`
+	// Fail instead of serving an expired certificate when no valid one
+	// is available, applying OnError.
+	RejectExpired bool `json:"reject_expired,omitempty"`
+	// Staple OCSP responses fetched from each certificate's responder.
+	// Responses are cached per certificate and refreshed in the background.
+	OCSPStapling bool `json:"ocsp_stapling,omitempty"`
+	// Field holding the private key PEM, when certificates are stored
+	// without their key. The key is shared by every cert field.
+	KeyKey string `json:"keyKey,omitempty"`
+	// Field holding the intermediate certificates, appended after the
+	// leaf of every cert field. Records without it are served as stored.
+	ChainKey string `json:"chainKey,omitempty"`
+	// Field holding a duration such as "1h" for which the record's
+	// certificates are cached instead of CacheTTL. Records without it use
+	// CacheTTL, "0s" keeps them out of the cache. Needs CacheTTL.
+	TTLKey string `json:"ttlKey,omitempty"`
+	// Redis key to look up, with {{prefix}} and {{sni}} placeholders,
+	// e.g. "certs/{{sni}}". Default "{{prefix}}:{{sni}}".
+	KeyTemplate string `json:"key_template,omitempty"`
+	// How the SNI is put into the key: "none" (default) as is, "sha256"
+	// as the lowercase hex SHA-256 of the SNI.
+	KeyHash string `json:"key_hash,omitempty"`
+	// Additional cert fields tried alongside CertKey. The longest-lived
+	// unexpired certificate among them is served.
+	CertKeys []string `json:"certKeys,omitempty"`
+	// Cert field to serve by the client's highest supported TLS version
+	// ("1.0" to "1.3"), replacing CertKey and CertKeys for those clients.
+	CertByVersion map[string]string `json:"cert_by_version,omitempty"`
+	// Cert fields by key algorithm ("ecdsa", "ed25519", "rsa"), replacing
+	// CertKey and CertKeys. The first one the client supports is served,
+	// in that order, falling back to whichever is present.
+	CertByAlgorithm map[string]string `json:"cert_by_algorithm,omitempty"`
+	// Relative weights by cert field. When set, handshakes are spread over
+	// the unexpired weighted fields instead of always serving the
+	// longest-lived one, e.g. {"cert": 90, "cert_new": 10} during rotation.
+	CertWeights map[string]int `json:"cert_weights,omitempty"`
+	// Codecs applied in order to the raw Redis value, e.g. ["base64", "gzip"].
+	Codecs []string `json:"codecs,omitempty"`
+	// Whether values are gzip compressed, after codecs: "gzip" always,
+	// "none" never. By default values starting with the gzip magic bytes
+	// are decompressed.
+	Compression string `json:"compression,omitempty"`
+	// Largest cert, key or chain value parsed, in bytes, checked both as
+	// read from Redis and after codecs. Default 256KiB, negative disables.
+	MaxCertSize int `json:"max_cert_size,omitempty"`
+	// Convert the SNI before building the Redis key: "unicode" turns
+	// punycode labels (xn--) into Unicode, "punycode" does the reverse.
+	// Names that fail to convert are looked up as sent.
+	SNIEncoding string `json:"sni_encoding,omitempty"`
+	// When the SNI has no record, try the wildcard form once, e.g.
+	// "*.example.com" for "foo.example.com".
+	WildcardFallback bool `json:"wildcard_fallback,omitempty"`
+	// Look up certificates in Redis even for TLS-ALPN ACME challenge
+	// handshakes, which are otherwise left to certmagic's challenge handler.
+	LookupACMEChallenge bool `json:"lookup_acme_challenge,omitempty"`
+	// Maximum number of concurrent Redis lookups, 0 means unlimited.
+	MaxConcurrentLookups int `json:"max_concurrent_lookups,omitempty"`
+	// How long a lookup waits for a free slot before failing.
+	LookupQueueTimeout caddy.Duration `json:"lookup_queue_timeout,omitempty"`
+	// Longest the Redis reads of one handshake may take before failing
+	// like a Redis error, as handshake contexts may have no deadline. Off
+	// when 0.
+	HandshakeTimeout caddy.Duration `json:"handshake_timeout,omitempty"`
+	// Stop reading Redis for BreakerCooldown (default 10s) after this
+	// many consecutive connection failures, then let one handshake probe
+	// it per cooldown. Off when 0.
+	BreakerThreshold int            `json:"breaker_threshold,omitempty"`
+	BreakerCooldown  caddy.Duration `json:"breaker_cooldown,omitempty"`
+	// Write 1 in LogSample certificate decision logs, 0 or 1 logs all of them.
+	LogSample int `json:"log_sample,omitempty"`
+	// Log the SNI of every handshake at debug level, sampled like the
+	// decision logs. Off by default as scans flood it and it leaks names.
+	LogSNI bool `json:"log_sni,omitempty"`
+	// What to return to certmagic when the SNI has no certificate (OnMiss)
+	// or Redis or the certificate data fails (OnError): "error" (default)
+	// returns the error, "decline" returns no certificate and no error.
+	OnMiss  string `json:"on_miss,omitempty"`
+	OnError string `json:"on_error,omitempty"`
+	// Like OnMiss, for cert fields that exist but are empty. Unlike a
+	// missing field this usually means corrupt data, and is logged as such.
+	OnEmpty string `json:"on_empty,omitempty"`
+	// Encoding of the certificate data after codecs: "pem" (default) or
+	// "der", the leaf, intermediates and private key back to back, or
+	// without the key when KeyKey is set.
+	Format string `json:"format,omitempty"`
+	// Certificate served when the SNI has no record, instead of OnMiss:
+	// a PEM bundle read once from FallbackCertFile, or the cert fields of
+	// the full Redis key FallbackCertKey, read like any other record.
+	FallbackCertFile string `json:"fallback_cert_file,omitempty"`
+	FallbackCertKey  string `json:"fallback_cert_key,omitempty"`
+	// Full Redis key of a sentinel record whose CertKey field must hold a
+	// parseable certificate, checked in Provision. Off when empty.
+	SelfTestKey string `json:"self_test_key,omitempty"`
+	// How long parsed certificates are kept in memory per SNI, skipping
+	// Redis and parsing on later handshakes. Off when 0.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	// How long SNIs without a record are remembered, so repeated misses
+	// skip Redis. Keep it short so new records show up soon. Off when 0.
+	NegativeCacheTTL caddy.Duration `json:"negative_cache_ttl,omitempty"`
+	// Maximum number of SNIs in the cache, default 10000.
+	CacheSize int `json:"cache_size,omitempty"`
+	// SNIs whose certificates are loaded into the cache in Provision, and
+	// a Redis set holding more of them. Need cache_ttl.
+	Preload    []string `json:"preload,omitempty"`
+	PreloadSet string   `json:"preload_set,omitempty"`
+	// Fail provisioning when Redis doesn't answer a PING. Defaults to
+	// true; the connection keeps being checked either way.
+	PingOnStart *bool `json:"ping_on_start,omitempty"`
+	// Redis pub/sub channel whose messages name an SNI to drop from the
+	// cache, e.g. after rotating its certificate. Needs CacheTTL.
+	InvalidateChannel string `json:"invalidate_channel,omitempty"`
+	// Drop cached entries as soon as their record changes, using Redis
+	// keyspace notifications. Falls back to the TTLs when the server has
+	// them disabled. Needs CacheTTL or NegativeCacheTTL.
+	WatchKeyspace bool `json:"watch_keyspace,omitempty"`
+	// When Redis fails, serve the last cached certificates for the SNI
+	// even past CacheTTL. Needs CacheTTL.
+	StaleOnError bool `json:"stale_on_error,omitempty"`
+	// http(s) URL or Redis key of a CRL (PEM or DER). Certificates whose
+	// serial it lists are not served. Off when empty.
+	CRL string `json:"crl,omitempty"`
+	// How often the CRL is reloaded, default 1h.
+	CRLRefresh caddy.Duration `json:"crl_refresh,omitempty"`
+	// File path or http(s) URL of a JSON document with "username" and
+	// "password", read on every (re)connect to follow secret rotation.
+	CredentialsSource string `json:"credentials_source,omitempty"`
+	// Longest host accepted for lookups, default 253. Longer hosts are
+	// rejected, or truncated when LongHost is "truncate".
+	MaxHostLength int    `json:"max_host_length,omitempty"`
+	LongHost      string `json:"long_host,omitempty"`
+	// Expose lookup and connection pool internals on the admin endpoint
+	// at /dynamic-routing/debug.
+	DebugStats bool `json:"debug_stats,omitempty"`
+	// Count requests per host in host_requests_total, labeling hosts in
+	// MetricsTrackedHosts by name and the rest by "tld" or as "other"
+	// ("tracked"). Off when empty.
+	MetricsHosts        string   `json:"metrics_hosts,omitempty"`
+	MetricsTrackedHosts []string `json:"metrics_tracked_hosts,omitempty"`
+	// When a record exists but has no certificate, obtain one through
+	// ACME and write it back to the record for every node to serve.
+	// ACMECA defaults to Let's Encrypt; ACMEEmail is the account contact.
+	ACMEFallback bool   `json:"acme_fallback,omitempty"`
+	ACMECA       string `json:"acme_ca,omitempty"`
+	ACMEEmail    string `json:"acme_email,omitempty"`
 
-	redisClient  *redis.Client
-	redisOptions redis.Options
-	logger       *zap.SugaredLogger
+	codecs     codecChain
+	hostLength hostLengthPolicy
+	hostLabels *hostLabeler
+	limiter    *lookupLimiter
+	breaker    *circuitBreaker
+	ops        *inFlightOps
+	crl        *crlChecker
+	fallback   *certCandidate
+	ocsp       *ocspStapler
+	acme       *acmeIssuer
+	certs      *ttlCache[[]certCandidate]
+	misses     *ttlCache[struct{}]
+	// events and eventsCtx emit cert_loaded, see emitLoaded.
+	events    *caddyevents.App
+	eventsCtx caddy.Context
+	// cancel stops background work such as CRL refreshes and the
+	// invalidation subscriber, in Cleanup.
+	cancel        context.CancelFunc
+	redisClient   redis.UniversalClient
+	redisOptions  redis.Options
+	redisTopology redisTopology
+	// fallbackRedis is the secondary Redis for failed reads, if any.
+	fallbackRedis *redis.Options
+	// redisKey is the key of a shared client in redisClients, if any.
+	redisKey  string
+	replicas  *redisReplicas
+	health    *redisHealth
+	logger    *zap.SugaredLogger
+	decisions *zap.SugaredLogger
 }
 
 func init() {
@@ -42,27 +268,1010 @@ func (rcg RedisCertGetter) CaddyModule() caddy.ModuleInfo {
 // Provision implements caddy.Provisioner.
 func (rcg *RedisCertGetter) Provision(ctx caddy.Context) error {
 	rcg.logger = ctx.Logger().Sugar()
-	rcg.redisClient = redis.NewClient(&rcg.redisOptions)
+	rcg.decisions = newDecisionLogger(ctx.Logger(), rcg.LogSample)
+
+	eventsApp, err := ctx.App("events")
+	if err != nil {
+		return fmt.Errorf("getting events app: %v", err)
+	}
+	rcg.events = eventsApp.(*caddyevents.App)
+	rcg.eventsCtx = ctx
+
+	codecs, err := newCodecChain(rcg.Codecs)
+	if err != nil {
+		return err
+	}
+	rcg.codecs = codecs
+
+	rcg.hostLength, err = newHostLengthPolicy(rcg.MaxHostLength, rcg.LongHost)
+	if err != nil {
+		return err
+	}
+	rcg.hostLabels, err = newHostLabeler(metricsModuleTLS, rcg.MetricsHosts, rcg.MetricsTrackedHosts)
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range []string{rcg.OnMiss, rcg.OnError, rcg.OnEmpty} {
+		switch policy {
+		case "", policyError, policyDecline:
+		default:
+			return fmt.Errorf("unknown policy: %s", policy)
+		}
+	}
+
+	if rcg.FallbackCertFile != "" && rcg.FallbackCertKey != "" {
+		return fmt.Errorf("fallback_cert: only one of file and redis key may be set")
+	}
+	if rcg.FallbackCertFile != "" {
+		fallback, err := loadFallbackCert(rcg.FallbackCertFile)
+		if err != nil {
+			return fmt.Errorf("fallback_cert: %v", err)
+		}
+		rcg.fallback = &fallback
+	}
+
+	switch rcg.SNIEncoding {
+	case "", sniEncodingUnicode, sniEncodingPunycode:
+	default:
+		return fmt.Errorf("unknown sni_encoding: %s", rcg.SNIEncoding)
+	}
+
+	switch rcg.Format {
+	case "", formatPEM, formatDER:
+	default:
+		return fmt.Errorf("unknown format: %s", rcg.Format)
+	}
+
+	switch rcg.Compression {
+	case "", compressionNone, compressionGzip:
+	default:
+		return fmt.Errorf("unknown compression: %s", rcg.Compression)
+	}
+
+	if err := checkKeyHash(rcg.KeyHash); err != nil {
+		return err
+	}
+
+	for name := range rcg.CertByVersion {
+		if _, ok := tlsVersions[name]; !ok {
+			return fmt.Errorf("cert_by_version: unknown TLS version %q", name)
+		}
+	}
+	for name := range rcg.CertByAlgorithm {
+		if !knownCertAlgorithm(name) {
+			return fmt.Errorf("cert_by_algorithm: unknown key algorithm %q", name)
+		}
+	}
+	for field, weight := range rcg.CertWeights {
+		if weight < 0 {
+			return fmt.Errorf("cert_weights: negative weight for %s", field)
+		}
+	}
+	if rcg.StaleOnError && rcg.CacheTTL <= 0 {
+		return fmt.Errorf("stale_on_error needs cache_ttl")
+	}
+	if rcg.TTLKey != "" && rcg.CacheTTL <= 0 {
+		return fmt.Errorf("ttlKey needs cache_ttl")
+	}
+	if (len(rcg.Preload) > 0 || rcg.PreloadSet != "") && rcg.CacheTTL <= 0 {
+		return fmt.Errorf("preload needs cache_ttl")
+	}
+	if rcg.InvalidateChannel != "" && rcg.CacheTTL <= 0 && rcg.NegativeCacheTTL <= 0 {
+		return fmt.Errorf("invalidate_channel needs cache_ttl or negative_cache_ttl")
+	}
+	if rcg.WatchKeyspace && rcg.CacheTTL <= 0 && rcg.NegativeCacheTTL <= 0 {
+		return fmt.Errorf("watch_keyspace needs cache_ttl or negative_cache_ttl")
+	}
+	rcg.certs = newTTLCache[[]certCandidate](time.Duration(rcg.CacheTTL), rcg.CacheSize)
+	rcg.misses = newTTLCache[struct{}](time.Duration(rcg.NegativeCacheTTL), rcg.CacheSize)
+	rcg.limiter = newLookupLimiter(metricsModuleTLS, rcg.MaxConcurrentLookups, time.Duration(rcg.LookupQueueTimeout))
+	rcg.breaker = newCircuitBreaker(rcg.BreakerThreshold, time.Duration(rcg.BreakerCooldown), rcg.logger)
+	rcg.ops = new(inFlightOps)
+
+	rcg.redisOptions, rcg.redisTopology, err = rcg.RedisConfig.options()
+	if err != nil {
+		return err
+	}
+	if rcg.FallbackRedis != nil {
+		if rcg.fallbackRedis, err = rcg.FallbackRedis.fallbackOptions(); err != nil {
+			return err
+		}
+	}
+	if rcg.CredentialsSource != "" {
+		rcg.redisOptions.CredentialsProvider = newCredentialsProvider(rcg.CredentialsSource, rcg.redisOptions.Username, rcg.redisOptions.Password, rcg.logger)
+	}
+	if topology := rcg.redisTopology; topology.masterName != "" || len(topology.clusterAddrs) > 0 {
+		if rcg.CredentialsSource != "" {
+			rcg.logger.Warn("credentials_source is only supported with a single Redis node, using static credentials")
+		}
+		if len(topology.clusterAddrs) > 0 && rcg.redisOptions.DB != 0 {
+			rcg.logger.Warnf("db %d is ignored in cluster mode", rcg.redisOptions.DB)
+		}
+	}
+	rcg.redisClient, rcg.redisKey, err = acquireRedisClient(&rcg.redisOptions, rcg.redisTopology)
+	if err != nil {
+		return err
+	}
+	rcg.replicas, err = acquireRedisReplicas(&rcg.redisOptions, rcg.ReadReplicas, rcg.fallbackRedis, rcg.logger)
+	if err != nil {
+		return err
+	}
+	var background context.Context
+	background, rcg.cancel = context.WithCancel(ctx)
+
+	rcg.health = watchRedisHealth(background, rcg.redisClient, rcg.logger)
+	if up, _, err := rcg.health.status(); !up && (rcg.PingOnStart == nil || *rcg.PingOnStart) {
+		return fmt.Errorf("pinging redis: %v", err)
+	}
+	if rcg.DebugStats {
+		registerDebugSource(rcg, rcg.debugStats)
+	}
+	if rcg.certs != nil {
+		registerCacheSource(rcg, metricsModuleTLS, rcg.Prefix, describedCache[[]certCandidate]{rcg.certs, describeCandidates})
+	}
+
+	if rcg.SelfTestKey != "" {
+		if err := rcg.selfTest(ctx); err != nil {
+			return fmt.Errorf("self test: %v", err)
+		}
+	}
+
+	if rcg.InvalidateChannel != "" {
+		subscribeInvalidations(background, rcg.redisClient, rcg.InvalidateChannel, rcg.logger, rcg.evict)
+	}
+
+	if rcg.WatchKeyspace {
+		if len(rcg.redisTopology.clusterAddrs) > 0 {
+			rcg.logger.Warn("watch_keyspace only sees changes on the cluster node it subscribes to")
+		}
+		subscribeKeyspace(background, rcg.redisClient, rcg.redisOptions.DB, rcg.renderKey("*"), rcg.logger, rcg.evictKey)
+	}
+
+	if rcg.OCSPStapling {
+		rcg.ocsp = newOCSPStapler(background, rcg.logger)
+	}
+
+	if rcg.ACMEFallback {
+		rcg.acme = newACMEIssuer(background, ctx.Storage(), rcg.ACMECA, rcg.ACMEEmail, ctx.Logger())
+	}
+
+	if rcg.CRL != "" {
+		rcg.crl, err = newCRLChecker(background, rcg.CRL, time.Duration(rcg.CRLRefresh), rcg.redisClient, rcg.logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	rcg.preload(ctx)
+
+	return nil
+}
+
+// preload loads the certificates of Preload and PreloadSet into the
+// cache. Failures are logged and skipped.
+func (rcg RedisCertGetter) preload(ctx context.Context) {
+	names := rcg.Preload
+	if rcg.PreloadSet != "" {
+		iter := rcg.redisClient.SScan(ctx, rcg.PreloadSet, 0, "", 0).Iterator()
+		for iter.Next(ctx) {
+			names = append(names[:len(names):len(names)], iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			rcg.logger.Warnf("Reading preload set %s: %v", rcg.PreloadSet, err)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	fields := rcg.certFields()
+	loaded := 0
+	for _, name := range names {
+		values, err := rcg.hmget(ctx, rcg.lookupKey(name), rcg.withKeyField(fields))
+		if err != nil {
+			rcg.logger.Warnf("Preloading certificate for %s: %v", name, err)
+			continue
+		}
+		candidates, err := rcg.parseCandidates(fields, values)
+		if len(candidates) == 0 {
+			if err == nil {
+				err = redis.Nil
+			}
+			rcg.logger.Warnf("Preloading certificate for %s: %v", name, err)
+			continue
+		}
+		rcg.cacheCandidates(name, name+"|"+strings.Join(fields, ","), candidates, values)
+		loaded++
+	}
+
+	rcg.logger.Infof("Preloaded %d of %d certificates", loaded, len(names))
+}
+
+// selfTest checks that the sentinel record holds a parseable certificate.
+func (rcg RedisCertGetter) selfTest(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	fields := []string{rcg.CertKey}
+	values, err := rcg.redisClient.HMGet(ctx, rcg.SelfTestKey, rcg.withKeyField(fields)...).Result()
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", rcg.SelfTestKey, err)
+	}
+
+	candidates, err := rcg.parseCandidates(fields, values)
+	if err != nil {
+		return fmt.Errorf("parsing field %s of %s: %v", rcg.CertKey, rcg.SelfTestKey, err)
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("field %s of %s: %v", rcg.CertKey, rcg.SelfTestKey, redis.Nil)
+	}
+
+	return nil
+}
+
+// Validate implements caddy.Validator, rejecting combinations that would
+// otherwise only fail handshakes.
+func (rcg *RedisCertGetter) Validate() error {
+	if err := validateRedisAddrs(&rcg.redisOptions, rcg.redisTopology, rcg.ReadReplicas); err != nil {
+		return err
+	}
+	if rcg.fallbackRedis != nil {
+		if err := validateRedisAddrs(rcg.fallbackRedis, redisTopology{}, nil); err != nil {
+			return fmt.Errorf("fallback_redis: %v", err)
+		}
+	}
+	if rcg.Prefix == "" && (rcg.KeyTemplate == "" || strings.Contains(rcg.KeyTemplate, prefixPlaceholder)) {
+		return fmt.Errorf("prefix can't be empty")
+	}
+	if rcg.KeyTemplate != "" && !strings.Contains(rcg.KeyTemplate, sniPlaceholder) && !strings.Contains(rcg.KeyTemplate, hostPlaceholder) {
+		return fmt.Errorf("key_template %q has no %s placeholder, every SNI would share one key", rcg.KeyTemplate, sniPlaceholder)
+	}
+
+	if len(rcg.CertByAlgorithm) > 0 && len(rcg.CertKeys) > 0 {
+		return fmt.Errorf("cert_by_algorithm replaces certKeys, set only one of them")
+	}
+	fields := rcg.certFields()
+	if len(rcg.CertByAlgorithm) == 0 && rcg.CertKey == "" {
+		return fmt.Errorf("certKey can't be empty")
+	}
+	for _, field := range rcg.CertByVersion {
+		fields = append(fields, field)
+	}
+	for _, field := range fields {
+		if rcg.KeyKey != "" && field == rcg.KeyKey {
+			return fmt.Errorf("keyKey %q is also a cert field", rcg.KeyKey)
+		}
+		if rcg.ChainKey != "" && field == rcg.ChainKey {
+			return fmt.Errorf("chainKey %q is also a cert field", rcg.ChainKey)
+		}
+		if rcg.TTLKey != "" && field == rcg.TTLKey {
+			return fmt.Errorf("ttlKey %q is also a cert field", rcg.TTLKey)
+		}
+	}
+	if rcg.ChainKey != "" && rcg.ChainKey == rcg.KeyKey {
+		return fmt.Errorf("chainKey and keyKey are both %q", rcg.ChainKey)
+	}
+	if rcg.TTLKey != "" && (rcg.TTLKey == rcg.KeyKey || rcg.TTLKey == rcg.ChainKey) {
+		return fmt.Errorf("ttlKey %q is also the key or chain field", rcg.TTLKey)
+	}
+	for field := range rcg.CertWeights {
+		if !containsString(fields, field) {
+			return fmt.Errorf("cert_weights: %q is not a cert field", field)
+		}
+	}
+	if rcg.ACMEFallback && (len(rcg.Codecs) > 0 || rcg.Format == formatDER || rcg.Compression == compressionGzip) {
+		return fmt.Errorf("acme_fallback writes PEM certificates, it can't be used with codecs, format der or compression gzip")
+	}
+	if rcg.Compression == compressionGzip && containsString(rcg.Codecs, "gzip") {
+		return fmt.Errorf("compression gzip and the gzip codec would decompress twice, set only one of them")
+	}
 
 	return nil
 }
 
 func (rcg RedisCertGetter) GetCertificate(ctx context.Context, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	rcg.logger.Debugf("SNI: %s", hello.ServerName)
+	if rcg.LogSNI {
+		rcg.decisions.Debugw("SNI", "server_name", hello.ServerName)
+	}
 
-	// get cert from redis
-	pem, err := rcg.redisClient.HGet(ctx, fmt.Sprintf("%s:%s", rcg.Prefix, hello.ServerName), rcg.CertKey).Result()
+	// leave challenge handshakes to certmagic, (nil, nil) lets it carry on
+	if !rcg.LookupACMEChallenge && isACMEChallenge(hello) {
+		rcg.logger.Debugf("Skipping ACME challenge for %s", hello.ServerName)
+		return nil, nil
+	}
+
+	dynamicRoutingMetrics.requests.WithLabelValues(metricsModuleTLS).Inc()
+	defer rcg.ops.start()()
+
+	serverName, err := rcg.hostLength.apply(hello.ServerName)
 	if err != nil {
+		rcg.logger.Warnf("Rejecting SNI: %v", err)
+		countError(metricsModuleTLS, errorTypeHost)
 		return nil, err
 	}
+	if encoded, err := encodeSNI(serverName, rcg.SNIEncoding); err != nil {
+		rcg.decisions.Debugw("Converting SNI failed, using it as sent", "server_name", hello.ServerName, "error", err)
+	} else {
+		serverName = encoded
+	}
+	rcg.hostLabels.count(serverName)
+
+	fields := rcg.certFields()
+	if field, ok := certFieldForVersion(rcg.CertByVersion, hello); ok {
+		fields = []string{field}
+	}
+
+	cacheKey := serverName + "|" + strings.Join(fields, ",")
+	candidates, cached := rcg.cachedCandidates(cacheKey)
+	loaded := false
+	if rcg.certs != nil {
+		countCacheLookup(metricsModuleTLS, cached)
+	}
+	if _, ok := rcg.misses.get(cacheKey); ok && !cached {
+		rcg.decisions.Debugw("Negative cache hit", "server_name", hello.ServerName)
+		return rcg.miss(ctx, hello.ServerName, fields)
+	}
+	if !cached {
+		var values []interface{}
+		err := errBreakerOpen
+		if rcg.breaker.allow() {
+			// a full limiter is handled like Redis being unavailable, so
+			// stale certificates and on_error apply
+			if err = rcg.limiter.acquire(ctx); err == nil {
+				values, err = rcg.fetch(ctx, hello.ServerName, serverName, fields)
+				rcg.limiter.release()
+				rcg.breaker.record(err)
+			}
+		}
+		if isCanceled(err) {
+			// the handshake is gone, so on_error does not apply
+			rcg.decisions.Debugw("Lookup canceled", "server_name", hello.ServerName, "error", err)
+			return nil, err
+		}
+		if err != nil {
+			countError(metricsModuleTLS, errorTypeRedis)
+			stale, ok := rcg.staleCandidates(cacheKey)
+			if !ok && errors.Is(err, errBreakerOpen) && rcg.fallback != nil {
+				rcg.decisions.Debugw("Circuit breaker open, serving fallback", "server_name", hello.ServerName)
+				return rcg.serve(hello.ServerName, *rcg.fallback, false), nil
+			}
+			if !ok {
+				return rcg.fail(rcg.OnError, hello.ServerName, newLookupError(ErrRedisUnavailable, hello.ServerName, err))
+			}
+			rcg.logger.Warnf("Serving stale certificate for %s, Redis failed: %v", hello.ServerName, err)
+			candidates = stale
+		} else {
+			candidates, err = rcg.parseCandidates(fields, values)
+			if len(candidates) == 0 {
+				switch {
+				case errors.Is(err, errEmptyCert):
+					countError(metricsModuleTLS, errorTypeEmpty)
+					return rcg.fail(rcg.OnEmpty, hello.ServerName, newLookupError(ErrInvalidRecord, hello.ServerName, err))
+				case errors.Is(err, errRevokedCert):
+					countError(metricsModuleTLS, errorTypeRevoked)
+					return rcg.fail(rcg.OnError, hello.ServerName, newLookupError(ErrInvalidRecord, hello.ServerName, err))
+				case err != nil:
+					countError(metricsModuleTLS, errorTypeParse)
+					return rcg.fail(rcg.OnError, hello.ServerName, newLookupError(ErrInvalidRecord, hello.ServerName, err))
+				}
+				issued, ok := rcg.issueCert(ctx, hello.ServerName, serverName, fields[0])
+				if !ok {
+					// removed from redis, don't serve it stale either
+					rcg.certs.delete(cacheKey)
+					rcg.misses.put(cacheKey, struct{}{})
+					return rcg.miss(ctx, hello.ServerName, fields)
+				}
+				candidates = issued
+			}
+			rcg.cacheCandidates(hello.ServerName, cacheKey, candidates, values)
+			loaded = true
+		}
+	}
+
+	now := time.Now()
+	if len(rcg.CertByAlgorithm) > 0 {
+		if selected, ok := selectCertForClient(candidates, hello, now); ok {
+			rcg.decisions.Debugw("Selected certificate supported by client",
+				"server_name", hello.ServerName,
+				"field", selected.field,
+				"candidates", len(candidates))
+			rcg.warnExpiring(hello.ServerName, selected, now)
+			return rcg.serve(hello.ServerName, selected, loaded), nil
+		}
+	}
+	if len(rcg.CertWeights) > 0 {
+		if selected, ok := selectWeightedCert(candidates, rcg.CertWeights, now); ok {
+			dynamicRoutingMetrics.certSelections.WithLabelValues(selected.field).Inc()
+			rcg.decisions.Debugw("Selected weighted certificate",
+				"server_name", hello.ServerName,
+				"field", selected.field,
+				"candidates", len(candidates),
+				"not_after", selected.notAfter())
+			rcg.warnExpiring(hello.ServerName, selected, now)
+			return rcg.serve(hello.ServerName, selected, loaded), nil
+		}
+	}
+
+	selected, valid := selectCert(candidates, now)
+	if !valid && rcg.RejectExpired {
+		countError(metricsModuleTLS, errorTypeExpired)
+		return rcg.fail(rcg.OnError, hello.ServerName, newLookupError(ErrInvalidRecord, hello.ServerName, fmt.Errorf("%w: %s expired %s", errExpiredCert, selected.field, selected.notAfter())))
+	}
+	if !valid {
+		rcg.logger.Warnf("All certificates for %s have expired, serving %s (expired %s)", hello.ServerName, selected.field, selected.notAfter())
+	} else if len(fields) > 1 {
+		rcg.decisions.Debugw("Selected longest-lived unexpired certificate",
+			"server_name", hello.ServerName,
+			"field", selected.field,
+			"candidates", len(candidates),
+			"not_after", selected.notAfter())
+	}
+	if valid {
+		rcg.warnExpiring(hello.ServerName, selected, now)
+	}
+
+	return rcg.serve(hello.ServerName, selected, loaded), nil
+}
+
+// fetch reads the cert fields of serverName, and of its wildcard form if
+// enabled and it has none, bounded by HandshakeTimeout. name is the SNI as
+// sent, for logs.
+func (rcg RedisCertGetter) fetch(ctx context.Context, name, serverName string, fields []string) ([]interface{}, error) {
+	lookupCtx, cancel := rcg.lookupContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+	values, err := rcg.hmget(lookupCtx, rcg.lookupKey(serverName), rcg.withKeyField(fields))
+	observeRedis(metricsModuleTLS, start)
+	if wildcard, ok := wildcardName(serverName); ok && rcg.WildcardFallback && err == nil && allNil(values) {
+		rcg.decisions.Debugw("No certificate, trying wildcard", "server_name", name, "wildcard", wildcard)
+		start = time.Now()
+		values, err = rcg.hmget(lookupCtx, rcg.lookupKey(wildcard), rcg.withKeyField(fields))
+		observeRedis(metricsModuleTLS, start)
+	}
+
+	return values, lookupTimedOut(ctx, lookupCtx, err)
+}
+
+// certFields returns the cert fields read for a handshake, unless
+// CertByVersion picks one.
+func (rcg RedisCertGetter) certFields() []string {
+	if len(rcg.CertByAlgorithm) > 0 {
+		return algorithmFields(rcg.CertByAlgorithm)
+	}
+
+	return append([]string{rcg.CertKey}, rcg.CertKeys...)
+}
+
+// serve staples selected and, when it was just read from Redis, emits
+// cert_loaded.
+func (rcg RedisCertGetter) serve(serverName string, selected certCandidate, loaded bool) *tls.Certificate {
+	rcg.ocsp.staple(&selected.cert)
+	if loaded {
+		rcg.emitLoaded(serverName, selected)
+	}
+
+	return &selected.cert
+}
+
+// emitLoaded emits a cert_loaded event for a certificate read from
+// Redis. Handlers run in the background so they never slow the handshake.
+// Nothing is emitted before Provision has found the events app.
+func (rcg RedisCertGetter) emitLoaded(serverName string, selected certCandidate) {
+	if rcg.events == nil {
+		return
+	}
+
+	fingerprint := sha256.Sum256(selected.cert.Leaf.Raw)
+	go rcg.events.Emit(rcg.eventsCtx, "cert_loaded", map[string]any{
+		"sni":         serverName,
+		"field":       selected.field,
+		"fingerprint": hex.EncodeToString(fingerprint[:]),
+		"not_after":   selected.notAfter(),
+	})
+}
+
+// warnExpiring logs, sampled like other decisions, when the served
+// certificate expires within ExpiryWarn.
+func (rcg RedisCertGetter) warnExpiring(serverName string, selected certCandidate, now time.Time) {
+	window := time.Duration(rcg.ExpiryWarn)
+	if window == 0 {
+		window = defaultExpiryWarn
+	}
+	if window < 0 || selected.notAfter().Sub(now) > window {
+		return
+	}
+
+	rcg.decisions.Warnw("Certificate expires soon",
+		"server_name", serverName,
+		"field", selected.field,
+		"not_after", selected.notAfter())
+}
+
+func (rcg RedisCertGetter) debugStats() debugStats {
+	stats := debugStats{
+		Module:       metricsModuleTLS,
+		Prefix:       rcg.Prefix,
+		Lookups:      rcg.limiter.inFlight(),
+		CacheEntries: rcg.certs.len(),
+		Pool:         rcg.redisClient.PoolStats(),
+		BreakerOpen:  rcg.breaker.isOpen(),
+	}
+	stats.setHealth(rcg.health)
+
+	return stats
+}
+
+// lookupContext bounds the Redis reads of a handshake under ctx by
+// HandshakeTimeout, if set.
+func (rcg RedisCertGetter) lookupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if rcg.HandshakeTimeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, time.Duration(rcg.HandshakeTimeout))
+}
+
+// lookupKey returns the key of serverName, hashed by KeyHash.
+func (rcg RedisCertGetter) lookupKey(serverName string) string {
+	return rcg.renderKey(hashKeyName(rcg.KeyHash, serverName))
+}
+
+// renderKey renders KeyTemplate for name as it appears in keys.
+func (rcg RedisCertGetter) renderKey(name string) string {
+	if rcg.KeyTemplate == "" {
+		return fmt.Sprintf("%s:%s", rcg.Prefix, name)
+	}
+
+	return strings.NewReplacer(
+		prefixPlaceholder, rcg.Prefix,
+		sniPlaceholder, name,
+		hostPlaceholder, name,
+	).Replace(rcg.KeyTemplate)
+}
+
+// evict drops the cached certificates of serverName. A wildcard such as
+// "*.example.com" drops those of every SNI it covers.
+func (rcg RedisCertGetter) evict(serverName string) {
+	match := func(key string) bool {
+		sni, _, _ := strings.Cut(key, "|")
+		if sni == serverName {
+			return true
+		}
+		wildcard, ok := wildcardName(sni)
+		return ok && wildcard == serverName
+	}
+	rcg.certs.deleteFunc(match)
+	rcg.misses.deleteFunc(match)
+}
+
+// evictKey drops the cached entries of the SNI whose record is key, as
+// told by keyspace notifications. Keys not matching KeyTemplate are ignored.
+func (rcg RedisCertGetter) evictKey(key string) {
+	// render the template around a name that can't occur in keys
+	before, after, _ := strings.Cut(rcg.renderKey("\x00"), "\x00")
+	if len(key) <= len(before)+len(after) || !strings.HasPrefix(key, before) || !strings.HasSuffix(key, after) {
+		return
+	}
+
+	name := key[len(before) : len(key)-len(after)]
+	if rcg.KeyHash == keyHashSHA256 {
+		rcg.evictHashed(name)
+		return
+	}
+	rcg.evict(name)
+}
+
+// evictHashed drops the cached entries of the SNIs whose record's name,
+// hashed by KeyHash, is hashed: the SNI itself or the wildcard covering it.
+func (rcg RedisCertGetter) evictHashed(hashed string) {
+	match := func(key string) bool {
+		sni, _, _ := strings.Cut(key, "|")
+		if hashKeyName(rcg.KeyHash, sni) == hashed {
+			return true
+		}
+		wildcard, ok := wildcardName(sni)
+		return ok && hashKeyName(rcg.KeyHash, wildcard) == hashed
+	}
+	rcg.certs.deleteFunc(match)
+	rcg.misses.deleteFunc(match)
+}
+
+// cacheCandidates caches the candidates read from values for the record's
+// TTLKey duration, or CacheTTL when it has none. Malformed durations are
+// logged and CacheTTL is used.
+func (rcg RedisCertGetter) cacheCandidates(serverName, key string, candidates []certCandidate, values []interface{}) {
+	value, ok := "", false
+	if rcg.TTLKey != "" {
+		// TTLKey is read last, see withKeyField
+		value, ok = values[len(values)-1].(string)
+	}
+	if !ok || value == "" {
+		rcg.certs.put(key, candidates)
+		return
+	}
+
+	ttl, err := caddy.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		rcg.logger.Warnf("Invalid %s %q for %s, using cache_ttl", rcg.TTLKey, value, serverName)
+		rcg.certs.put(key, candidates)
+		return
+	}
+	if ttl == 0 {
+		rcg.certs.delete(key)
+		return
+	}
+
+	rcg.decisions.Debugw("Caching with record TTL", "server_name", serverName, "ttl", ttl)
+	rcg.certs.putTTL(key, candidates, ttl)
+}
+
+// describeCandidates adds the field and expiry of each cached certificate
+// to entry.
+func describeCandidates(candidates []certCandidate, entry *cachedEntry) {
+	for _, candidate := range candidates {
+		entry.Certs = append(entry.Certs, cachedCert{Field: candidate.field, NotAfter: candidate.notAfter()})
+	}
+}
+
+// staleCandidates returns the cached candidates for key regardless of
+// cache_ttl when stale_on_error is set, skipping revoked ones.
+func (rcg RedisCertGetter) staleCandidates(key string) ([]certCandidate, bool) {
+	if !rcg.StaleOnError {
+		return nil, false
+	}
+
+	candidates, ok := rcg.certs.getStale(key)
+	if !ok || rcg.crl == nil {
+		return candidates, ok
+	}
+
+	var valid []certCandidate
+	for _, c := range candidates {
+		if !rcg.crl.isRevoked(c.cert.Leaf) {
+			valid = append(valid, c)
+		}
+	}
+
+	return valid, len(valid) > 0
+}
+
+// cachedCandidates returns the cached candidates for key unless one of
+// them has been revoked since, in which case the entry is dropped.
+func (rcg RedisCertGetter) cachedCandidates(key string) ([]certCandidate, bool) {
+	candidates, ok := rcg.certs.get(key)
+	if !ok || rcg.crl == nil {
+		return candidates, ok
+	}
+
+	for _, c := range candidates {
+		if rcg.crl.isRevoked(c.cert.Leaf) {
+			rcg.certs.delete(key)
+			return nil, false
+		}
+	}
+
+	return candidates, true
+}
+
+// allNil reports whether HMGET found none of the fields.
+func allNil(values []interface{}) bool {
+	for _, v := range values {
+		if v != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// miss serves the fallback certificate for an SNI without a record, or applies OnMiss.
+func (rcg RedisCertGetter) miss(ctx context.Context, serverName string, fields []string) (*tls.Certificate, error) {
+	if fallback, ok := rcg.fallbackCert(ctx, fields); ok {
+		rcg.decisions.Debugw("No certificate, serving fallback", "server_name", serverName)
+		rcg.ocsp.staple(&fallback.cert)
+		return &fallback.cert, nil
+	}
+
+	return rcg.fail(rcg.OnMiss, serverName, newLookupError(ErrCertNotFound, serverName, redis.Nil))
+}
+
+// fallbackCert returns the configured fallback certificate. One read
+// from FallbackCertKey that fails or finds nothing is logged and ok is
+// false, so OnMiss applies.
+func (rcg RedisCertGetter) fallbackCert(ctx context.Context, fields []string) (certCandidate, bool) {
+	if rcg.fallback != nil {
+		return *rcg.fallback, true
+	}
+	if rcg.FallbackCertKey == "" {
+		return certCandidate{}, false
+	}
+
+	cacheKey := rcg.FallbackCertKey + "|" + strings.Join(fields, ",")
+	if candidates, ok := rcg.cachedCandidates(cacheKey); ok {
+		selected, _ := selectCert(candidates, time.Now())
+		return selected, true
+	}
+
+	values, err := rcg.hmget(ctx, rcg.FallbackCertKey, rcg.withKeyField(fields))
+	if err != nil {
+		if !isCanceled(err) {
+			rcg.logger.Warnf("Reading fallback certificate %s: %v", rcg.FallbackCertKey, err)
+		}
+		return certCandidate{}, false
+	}
+	candidates, err := rcg.parseCandidates(fields, values)
+	if len(candidates) == 0 {
+		if err == nil {
+			err = redis.Nil
+		}
+		rcg.logger.Warnf("Loading fallback certificate %s: %v", rcg.FallbackCertKey, err)
+		return certCandidate{}, false
+	}
+	rcg.certs.put(cacheKey, candidates)
+
+	selected, _ := selectCert(candidates, time.Now())
+	return selected, true
+}
+
+// loadFallbackCert reads a PEM bundle with certificate chain and key.
+func loadFallbackCert(path string) (certCandidate, error) {
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return certCandidate{}, err
+	}
+	cert, err := tlsCertFromCertAndKeyPEMBundle(bundle)
+	if err != nil {
+		return certCandidate{}, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return newCertCandidate("fallback", cert)
+}
+
+// fail applies a miss or error policy. certmagic logs errors from a
+// Manager and moves on to the next one, while (nil, nil) moves on silently.
+func (rcg RedisCertGetter) fail(policy string, serverName string, err error) (*tls.Certificate, error) {
+	if policy == policyDecline {
+		rcg.logger.Debugf("Declining %s: %v", serverName, err)
+		return nil, nil
+	}
+
+	return nil, err
+}
+
+// parseCandidates decodes and parses each cert field found in redis. With
+// a single field its error is returned; with several, broken fields are
+// skipped so another may still be served.
+func (rcg RedisCertGetter) parseCandidates(fields []string, values []interface{}) ([]certCandidate, error) {
+	// KeyKey and ChainKey follow the cert fields, see withKeyField
+	extra := len(fields)
+	var key []byte
+	if rcg.KeyKey != "" {
+		value, ok := values[extra].(string)
+		if !ok || value == "" {
+			if allNil(values[:len(fields)]) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("%w: %s", errMissingKey, rcg.KeyKey)
+		}
+		key = []byte(value)
+		extra++
+	}
+
+	var chain []byte
+	if rcg.ChainKey != "" {
+		if value, ok := values[extra].(string); ok && value != "" {
+			chain = []byte(value)
+		}
+	}
+
+	var candidates []certCandidate
+	var lastErr error
+	for i, field := range fields {
+		// go-redis returns bulk strings unmodified, so converting to
+		// bytes keeps binary values intact
+		value, ok := values[i].(string)
+		if !ok {
+			continue
+		}
+		if value == "" {
+			// present but empty points at a broken provisioning job
+			rcg.logger.Warnf("Cert field %s is empty", field)
+			lastErr = errEmptyCert
+			continue
+		}
+
+		candidate, err := rcg.parseCandidate(field, []byte(value), key, chain)
+		if err == nil && rcg.crl != nil && rcg.crl.isRevoked(candidate.cert.Leaf) {
+			err = fmt.Errorf("%w: serial %s", errRevokedCert, candidate.cert.Leaf.SerialNumber)
+		}
+		if err != nil {
+			if len(fields) == 1 {
+				return nil, err
+			}
+			rcg.logger.Warnf("Skipping cert field %s: %v", field, err)
+			lastErr = err
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates, lastErr
+}
+
+// parseCandidate parses value as a cert and key PEM bundle, or as the
+// certificate chain for key when KeyKey is set, and appends chain.
+func (rcg RedisCertGetter) parseCandidate(field string, value, key, chain []byte) (certCandidate, error) {
+	bundle, err := rcg.decode(field, value)
+	if err != nil {
+		return certCandidate{}, err
+	}
+
+	if rcg.Format != formatDER && !bytes.Contains(bundle, []byte("-----BEGIN")) {
+		return certCandidate{}, errNotPEM
+	}
+
+	var keyData []byte
+	if key != nil {
+		if keyData, err = rcg.decode(rcg.KeyKey, key); err != nil {
+			return certCandidate{}, err
+		}
+	}
 
 	// convert to X509
-	cert, err := tlsCertFromCertAndKeyPEMBundle([]byte(pem))
+	var cert tls.Certificate
+	switch {
+	case rcg.Format == formatDER:
+		cert, err = tlsCertFromDER(bundle, keyData)
+	case key == nil:
+		cert, err = tlsCertFromCertAndKeyPEMBundle(bundle)
+	default:
+		cert, err = tls.X509KeyPair(bundle, keyData)
+	}
 	if err != nil {
-		return nil, err
+		return certCandidate{}, err
 	}
 
-	return &cert, nil
+	if chain != nil {
+		decoded, err := rcg.decode(rcg.ChainKey, chain)
+		if err != nil {
+			return certCandidate{}, err
+		}
+		intermediates, err := parseChain(decoded, rcg.Format)
+		if err != nil {
+			return certCandidate{}, fmt.Errorf("%s: %v", rcg.ChainKey, err)
+		}
+		if err := appendChain(&cert, intermediates); err != nil {
+			return certCandidate{}, fmt.Errorf("%s: %v", rcg.ChainKey, err)
+		}
+	}
+
+	return newCertCandidate(field, cert)
+}
+
+// decode applies the codecs and Compression to the value of field,
+// rejecting it when over MaxCertSize before or after, e.g. when gzip
+// expands it.
+func (rcg RedisCertGetter) decode(field string, value []byte) ([]byte, error) {
+	limit := rcg.MaxCertSize
+	if limit == 0 {
+		limit = defaultMaxCertSize
+	}
+	if limit > 0 && len(value) > limit {
+		return nil, fmt.Errorf("%w: %s is %d bytes, limit %d", errCertTooLarge, field, len(value), limit)
+	}
+
+	decoded, err := rcg.codecs.Decode(value)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", field, err)
+	}
+	if rcg.Compression == compressionGzip || rcg.Compression == "" && isGzip(decoded) {
+		decoded, err = gunzip(decoded, limit)
+		if errors.Is(err, errGzipTooLarge) {
+			return nil, fmt.Errorf("%w: %s decompresses to over %d bytes", errCertTooLarge, field, limit)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decompressing %s: %v", field, err)
+		}
+	}
+	if limit > 0 && len(decoded) > limit {
+		return nil, fmt.Errorf("%w: %s decodes to %d bytes, limit %d", errCertTooLarge, field, len(decoded), limit)
+	}
+
+	return decoded, nil
+}
+
+// issueCert obtains a certificate through ACME for name when the record
+// of serverName exists without one, and writes it to field of the record.
+// Only existing records qualify, so arbitrary SNIs can't run up issuance.
+// ok is false when ACME is off or doesn't apply, or issuance fails or
+// outlasts the handshake; it then finishes in the background.
+func (rcg RedisCertGetter) issueCert(ctx context.Context, name, serverName, field string) ([]certCandidate, bool) {
+	name = strings.ToLower(name)
+	if rcg.acme == nil || !certmagic.SubjectQualifiesForPublicCert(name) {
+		return nil, false
+	}
+
+	key := rcg.lookupKey(serverName)
+	if n, err := rcg.redisClient.Exists(ctx, key).Result(); err != nil || n == 0 {
+		return nil, false
+	}
+
+	type issued struct {
+		candidate certCandidate
+		err       error
+	}
+	done := make(chan issued, 1)
+	go func() {
+		candidate, err := rcg.storeIssuedCert(key, name, field)
+		done <- issued{candidate, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		rcg.decisions.Debugw("Handshake ended while obtaining certificate", "server_name", name)
+		return nil, false
+	case result := <-done:
+		if errors.Is(result.err, errACMELocked) {
+			rcg.decisions.Debugw("Certificate is being obtained by another node", "server_name", name)
+			return nil, false
+		}
+		if result.err != nil {
+			rcg.logger.Warnf("Obtaining certificate for %s: %v", name, result.err)
+			return nil, false
+		}
+		return []certCandidate{result.candidate}, true
+	}
+}
+
+// storeIssuedCert obtains the certificate for name and writes it to field
+// of key, with the private key in KeyKey if set.
+func (rcg RedisCertGetter) storeIssuedCert(key, name, field string) (certCandidate, error) {
+	certPEM, keyPEM, err := rcg.acme.obtain(rcg.redisClient, key+acmeLockSuffix, name)
+	if err != nil {
+		return certCandidate{}, err
+	}
+
+	value, keyValue := certPEM, keyPEM
+	values := []interface{}{field, value, rcg.KeyKey, keyValue}
+	if rcg.KeyKey == "" {
+		value, keyValue = append(certPEM, keyPEM...), nil
+		values = []interface{}{field, value}
+	}
+	if err := rcg.redisClient.HSet(rcg.acme.ctx, key, values...).Err(); err != nil {
+		return certCandidate{}, fmt.Errorf("writing to %s: %v", key, err)
+	}
+
+	return rcg.parseCandidate(field, value, keyValue, nil)
+}
+
+// hmget reads fields of key, from a read replica if configured.
+func (rcg RedisCertGetter) hmget(ctx context.Context, key string, fields []string) ([]interface{}, error) {
+	var values []interface{}
+	err := rcg.replicas.read(rcg.redisClient, func(client redis.UniversalClient) (err error) {
+		values, err = client.HMGet(ctx, key, fields...).Result()
+		return err
+	})
+
+	return values, err
+}
+
+// withKeyField appends KeyKey, ChainKey and TTLKey, if set, to the cert
+// fields to read.
+func (rcg RedisCertGetter) withKeyField(fields []string) []string {
+	fields = fields[:len(fields):len(fields)]
+	if rcg.KeyKey != "" {
+		fields = append(fields, rcg.KeyKey)
+	}
+	if rcg.ChainKey != "" {
+		fields = append(fields, rcg.ChainKey)
+	}
+	if rcg.TTLKey != "" {
+		fields = append(fields, rcg.TTLKey)
+	}
+
+	return fields
 }
 
 // UnmarshalCaddyfile deserializes Caddyfile tokens into ts.
@@ -72,62 +1281,371 @@ func (rcg RedisCertGetter) GetCertificate(ctx context.Context, hello *tls.Client
 //	  }
 func (rcg *RedisCertGetter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	// default config
-	host := "127.0.0.1"
-	port := "6379"
-	db := 0
 	prefix := "s"
 	certKey := "cert"
 
 	for d.Next() {
 		for d.NextBlock(0) {
-			switch d.Val() {
-			case "host":
-				if d.NextArg() {
-					host = d.Val()
-				}
-			case "port":
-				if d.NextArg() {
-					port = d.Val()
+			if handled, err := rcg.RedisConfig.unmarshalCaddyfileDirective(d); handled {
+				if err != nil {
+					return err
 				}
-			case "db":
-				if d.NextArg() {
-					parsedDb, err := strconv.Atoi(d.Val())
-					if err != nil {
-						return d.ArgErr()
-					}
-					db = parsedDb
+				continue
+			}
+
+			switch d.Val() {
+			case "fallback_redis":
+				config, err := unmarshalRedisFallback(d)
+				if err != nil {
+					return err
 				}
+				rcg.FallbackRedis = config
 			case "prefix":
 				if d.NextArg() {
 					prefix = d.Val()
 				}
 				rcg.Prefix = prefix
 
+			case "keyKey":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.KeyKey = d.Val()
+			case "chainKey":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.ChainKey = d.Val()
+			case "ttlKey":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.TTLKey = d.Val()
+			case "key_template":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.KeyTemplate = d.Val()
 			case "certKey":
 				if d.NextArg() {
 					certKey = d.Val()
 				}
 				rcg.CertKey = certKey
+				rcg.CertKeys = d.RemainingArgs()
+			case "cert_by_version":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if _, ok := tlsVersions[args[0]]; !ok {
+					return d.Errf("unknown TLS version: %s", args[0])
+				}
+				if rcg.CertByVersion == nil {
+					rcg.CertByVersion = make(map[string]string)
+				}
+				rcg.CertByVersion[args[0]] = args[1]
+			case "cert_by_algorithm":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if !knownCertAlgorithm(args[0]) {
+					return d.Errf("unknown key algorithm: %s", args[0])
+				}
+				if rcg.CertByAlgorithm == nil {
+					rcg.CertByAlgorithm = make(map[string]string)
+				}
+				rcg.CertByAlgorithm[args[0]] = args[1]
+			case "cert_weight":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				weight, err := strconv.Atoi(args[1])
+				if err != nil || weight < 0 {
+					return d.Errf("invalid cert_weight: %s", args[1])
+				}
+				if rcg.CertWeights == nil {
+					rcg.CertWeights = make(map[string]int)
+				}
+				rcg.CertWeights[args[0]] = weight
+			case "on_miss":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.OnMiss = d.Val()
+			case "on_empty":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.OnEmpty = d.Val()
+			case "on_error":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.OnError = d.Val()
+			case "format":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.Format = d.Val()
+			case "self_test":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.SelfTestKey = d.Val()
+			case "sni_encoding":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.SNIEncoding = d.Val()
+			case "wildcard_fallback":
+				rcg.WildcardFallback = true
+			case "lookup_acme_challenge":
+				rcg.LookupACMEChallenge = true
+			case "max_concurrent_lookups":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				max, err := strconv.Atoi(d.Val())
+				if err != nil || max < 0 {
+					return d.Errf("invalid max_concurrent_lookups: %s", d.Val())
+				}
+				rcg.MaxConcurrentLookups = max
+			case "lookup_queue_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid lookup_queue_timeout: %v", err)
+				}
+				rcg.LookupQueueTimeout = caddy.Duration(timeout)
+			case "handshake_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(d.Val())
+				if err != nil || timeout <= 0 {
+					return d.Errf("invalid handshake_timeout: %s", d.Val())
+				}
+				rcg.HandshakeTimeout = caddy.Duration(timeout)
+			case "breaker_threshold":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				threshold, err := strconv.Atoi(d.Val())
+				if err != nil || threshold < 0 {
+					return d.Errf("invalid breaker_threshold: %s", d.Val())
+				}
+				rcg.BreakerThreshold = threshold
+			case "breaker_cooldown":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cooldown, err := caddy.ParseDuration(d.Val())
+				if err != nil || cooldown <= 0 {
+					return d.Errf("invalid breaker_cooldown: %s", d.Val())
+				}
+				rcg.BreakerCooldown = caddy.Duration(cooldown)
+			case "log_sni":
+				rcg.LogSNI = true
+			case "debug_stats":
+				rcg.DebugStats = true
+			case "metrics_hosts":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.MetricsHosts = d.Val()
+				rcg.MetricsTrackedHosts = d.RemainingArgs()
+			case "log_sample":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				sample, err := strconv.Atoi(d.Val())
+				if err != nil || sample < 0 {
+					return d.Errf("invalid log_sample: %s", d.Val())
+				}
+				rcg.LogSample = sample
+			case "max_host_length":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				max, err := strconv.Atoi(args[0])
+				if err != nil || max <= 0 {
+					return d.Errf("invalid max_host_length: %s", args[0])
+				}
+				rcg.MaxHostLength = max
+				if len(args) == 2 {
+					rcg.LongHost = args[1]
+				}
+			case "cache_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
+				if err != nil || ttl < 0 {
+					return d.Errf("invalid cache_ttl: %s", d.Val())
+				}
+				rcg.CacheTTL = caddy.Duration(ttl)
+			case "negative_cache_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
+				if err != nil || ttl <= 0 {
+					return d.Errf("invalid negative_cache_ttl: %s", d.Val())
+				}
+				rcg.NegativeCacheTTL = caddy.Duration(ttl)
+			case "cache_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(d.Val())
+				if err != nil || size <= 0 {
+					return d.Errf("invalid cache_size: %s", d.Val())
+				}
+				rcg.CacheSize = size
+			case "preload":
+				names := d.RemainingArgs()
+				if len(names) == 0 {
+					return d.ArgErr()
+				}
+				rcg.Preload = append(rcg.Preload, names...)
+			case "preload_set":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.PreloadSet = d.Val()
+			case "ping_on_start":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ping, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid ping_on_start: %s", d.Val())
+				}
+				rcg.PingOnStart = &ping
+			case "invalidate_channel":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.InvalidateChannel = d.Val()
+			case "watch_keyspace":
+				rcg.WatchKeyspace = true
+			case "expiry_warn":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				window, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid expiry_warn: %v", err)
+				}
+				rcg.ExpiryWarn = caddy.Duration(window)
+			case "ocsp_stapling":
+				rcg.OCSPStapling = true
+			case "reject_expired":
+				rcg.RejectExpired = true
+			case "stale_on_error":
+				rcg.StaleOnError = true
+			case "fallback_cert":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				switch args[0] {
+				case "file":
+					rcg.FallbackCertFile = args[1]
+				case "redis":
+					rcg.FallbackCertKey = args[1]
+				default:
+					return d.Errf("unknown fallback_cert source: %s", args[0])
+				}
+			case "crl":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				rcg.CRL = args[0]
+				if len(args) == 2 {
+					refresh, err := caddy.ParseDuration(args[1])
+					if err != nil {
+						return d.Errf("invalid crl refresh: %v", err)
+					}
+					rcg.CRLRefresh = caddy.Duration(refresh)
+				}
+			case "credentials":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.CredentialsSource = d.Val()
+			case "acme_fallback":
+				rcg.ACMEFallback = true
+			case "acme_ca":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.ACMECA = d.Val()
+			case "acme_email":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.ACMEEmail = d.Val()
+			case "max_cert_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_cert_size: %s", d.Val())
+				}
+				rcg.MaxCertSize = size
+			case "compression":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.Compression = d.Val()
+			case "key_hash":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rcg.KeyHash = d.Val()
+			case "codecs":
+				rcg.Codecs = d.RemainingArgs()
+				if len(rcg.Codecs) == 0 {
+					return d.ArgErr()
+				}
 			default:
 				return d.Errf("Unknown field: %s", d.Val())
 			}
 		}
 	}
 
-	// prepare options for new redis
-	rcg.redisOptions = redis.Options{
-		Addr: strings.Join([]string{host, port}, ":"),
-		DB:   db,
+	// catch conflicting settings and unreadable TLS files early
+	if _, _, err := rcg.RedisConfig.options(); err != nil {
+		return d.Err(err.Error())
 	}
 
 	return nil
-
 }
 
 // Cleanup frees up resources allocated during Provision.
 func (rcg *RedisCertGetter) Cleanup() error {
 	rcg.logger.Debug("Cleaning up tls redis")
-	err := rcg.redisClient.Close()
+	if n := rcg.ops.drain(drainTimeout); n > 0 {
+		rcg.logger.Warnf("Releasing Redis with %d handshake lookups still running after %s", n, drainTimeout)
+	}
+	if rcg.cancel != nil {
+		rcg.cancel()
+	}
+	rcg.acme.stop()
+	unregisterDebugSource(rcg)
+	unregisterCacheSource(rcg)
+	if err := rcg.replicas.release(); err != nil {
+		return err
+	}
+	err := releaseRedisClient(rcg.redisClient, rcg.redisKey)
 	if err != nil {
 		return err
 	}
@@ -135,6 +1653,17 @@ func (rcg *RedisCertGetter) Cleanup() error {
 	return nil
 }
 
+// isACMEChallenge reports whether the handshake is for a TLS-ALPN-01 challenge.
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	for _, proto := range hello.SupportedProtos {
+		if proto == acmeTLS1Protocol {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Ref caddyserver/caddy/modules/caddytls/folderloader.go:84
 // This func not exported by caddy
 func tlsCertFromCertAndKeyPEMBundle(bundle []byte) (tls.Certificate, error) {
@@ -206,5 +1735,6 @@ func tlsCertFromCertAndKeyPEMBundle(bundle []byte) (tls.Certificate, error) {
 var (
 	_ certmagic.Manager     = (*RedisCertGetter)(nil)
 	_ caddy.Provisioner     = (*RedisCertGetter)(nil)
+	_ caddy.Validator       = (*RedisCertGetter)(nil)
 	_ caddyfile.Unmarshaler = (*RedisCertGetter)(nil)
 )
@@ -0,0 +1,556 @@
+package guard
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// fakeRedis is a go-redis client served from hashes in memory by a hook,
+// without a server. It answers HGET, HMGET and EXISTS; other commands fail.
+type fakeRedis struct {
+	*redis.Client
+
+	mu     sync.Mutex
+	hashes map[string]map[string]string
+	// err, if set, fails every command.
+	err error
+	// block makes commands wait until their context is done.
+	block bool
+	// keys and ctxs record the key and context of every command.
+	keys []string
+	ctxs []context.Context
+}
+
+func newFakeRedis(hashes map[string]map[string]string) *fakeRedis {
+	f := &fakeRedis{
+		Client: redis.NewClient(&redis.Options{Addr: "fake.invalid:6379"}),
+		hashes: hashes,
+	}
+	f.AddHook(f)
+
+	return f
+}
+
+func (f *fakeRedis) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (f *fakeRedis) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (f *fakeRedis) ProcessHook(redis.ProcessHook) redis.ProcessHook {
+	return f.process
+}
+
+// process answers cmd from the hashes instead of sending it.
+func (f *fakeRedis) process(ctx context.Context, cmd redis.Cmder) error {
+	args := cmd.Args()
+	var keys []interface{}
+	switch cmd.Name() {
+	case "exists":
+		keys = args[1:]
+	case "hget", "hmget":
+		keys = args[1:2]
+	default:
+		return fmt.Errorf("fake redis: unsupported command %s", cmd.Name())
+	}
+
+	f.mu.Lock()
+	for _, key := range keys {
+		f.keys = append(f.keys, key.(string))
+		f.ctxs = append(f.ctxs, ctx)
+	}
+	block, err := f.block, f.err
+	f.mu.Unlock()
+	if block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch cmd := cmd.(type) {
+	case *redis.IntCmd:
+		var n int64
+		for _, key := range keys {
+			if _, ok := f.hashes[key.(string)]; ok {
+				n++
+			}
+		}
+		cmd.SetVal(n)
+	case *redis.StringCmd:
+		value, ok := f.hashes[keys[0].(string)][args[2].(string)]
+		if !ok {
+			return redis.Nil
+		}
+		cmd.SetVal(value)
+	case *redis.SliceCmd:
+		values := make([]interface{}, len(args)-2)
+		for i, field := range args[2:] {
+			if value, ok := f.hashes[keys[0].(string)][field.(string)]; ok {
+				values[i] = value
+			}
+		}
+		cmd.SetVal(values)
+	}
+
+	return nil
+}
+
+// commands returns the keys of the commands run so far.
+func (f *fakeRedis) commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.keys...)
+}
+
+// contexts returns the contexts of the commands run so far.
+func (f *fakeRedis) contexts() []context.Context {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]context.Context(nil), f.ctxs...)
+}
+
+// testCertificate returns the DER of a self-signed certificate for name
+// and of its PKCS #8 private key.
+func testCertificate(t *testing.T, name string) (certDER, keyDER []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+	}
+	certDER, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err = x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certDER, keyDER
+}
+
+// testPEMBundle returns a certificate and key PEM bundle for name, as
+// stored in a cert field.
+func testPEMBundle(t *testing.T, name string) string {
+	t.Helper()
+
+	certDER, keyDER := testCertificate(t, name)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+// newTestCertGetter returns a RedisCertGetter reading certs:<sni> from
+// client, set up as far as GetCertificate needs without Provision.
+func newTestCertGetter(t *testing.T, client *fakeRedis) *RedisCertGetter {
+	t.Helper()
+
+	ensureMetrics()
+	hostLength, err := newHostLengthPolicy(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &RedisCertGetter{
+		Prefix:      "certs",
+		CertKey:     "cert",
+		hostLength:  hostLength,
+		ops:         new(inFlightOps),
+		redisClient: client.Client,
+		logger:      zap.NewNop().Sugar(),
+		decisions:   zap.NewNop().Sugar(),
+	}
+}
+
+func TestGetCertificateACMEChallenge(t *testing.T) {
+	bundle := testPEMBundle(t, "example.com")
+
+	tests := []struct {
+		name         string
+		protos       []string
+		lookupACME   bool
+		wantCert     bool
+		wantCommands int
+	}{
+		{name: "challenge", protos: []string{acmeTLS1Protocol}, wantCert: false, wantCommands: 0},
+		{name: "challenge among other protocols", protos: []string{"h2", acmeTLS1Protocol}, wantCert: false, wantCommands: 0},
+		{name: "regular handshake", protos: []string{"h2", "http/1.1"}, wantCert: true, wantCommands: 1},
+		{name: "no ALPN", protos: nil, wantCert: true, wantCommands: 1},
+		{name: "challenge with lookup_acme_challenge", protos: []string{acmeTLS1Protocol}, lookupACME: true, wantCert: true, wantCommands: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeRedis(map[string]map[string]string{
+				"certs:example.com": {"cert": bundle},
+			})
+			rcg := newTestCertGetter(t, client)
+			rcg.LookupACMEChallenge = tt.lookupACME
+
+			cert, err := rcg.GetCertificate(context.Background(), &tls.ClientHelloInfo{
+				ServerName:      "example.com",
+				SupportedProtos: tt.protos,
+			})
+			if err != nil {
+				t.Fatalf("GetCertificate() error = %v", err)
+			}
+			if (cert != nil) != tt.wantCert {
+				t.Errorf("GetCertificate() cert = %v, want cert %v", cert != nil, tt.wantCert)
+			}
+			if got := len(client.commands()); got != tt.wantCommands {
+				t.Errorf("Redis commands = %d, want %d", got, tt.wantCommands)
+			}
+		})
+	}
+}
+
+func TestGetCertificateBinaryValues(t *testing.T) {
+	certDER, keyDER := testCertificate(t, "example.com")
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	if _, err := zw.Write(bundle); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		codecs  []string
+		wantErr error
+	}{
+		{name: "gzip codec", value: gzipped.String(), codecs: []string{"gzip"}},
+		{name: "base64 and gzip codecs", value: base64.StdEncoding.EncodeToString(gzipped.Bytes()), codecs: []string{"base64", "gzip"}},
+		{name: "gzip detected", value: gzipped.String()},
+		{name: "DER without codec", value: string(certDER) + string(keyDER), wantErr: errNotPEM},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcg := newTestCertGetter(t, newFakeRedis(map[string]map[string]string{
+				"certs:example.com": {"cert": tt.value},
+			}))
+			codecs, err := newCodecChain(tt.codecs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rcg.codecs = codecs
+
+			cert, err := rcg.GetCertificate(context.Background(), &tls.ClientHelloInfo{ServerName: "example.com"})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("GetCertificate() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetCertificate() error = %v", err)
+			}
+			if cert == nil || len(cert.Certificate) != 1 || !bytes.Equal(cert.Certificate[0], certDER) {
+				t.Error("GetCertificate() did not serve the stored certificate unchanged")
+			}
+		})
+	}
+}
+
+func TestGetCertificateBinaryDER(t *testing.T) {
+	certDER, keyDER := testCertificate(t, "example.com")
+	bundle := string(certDER) + string(keyDER)
+
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	if _, err := zw.Write([]byte(bundle)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		record map[string]string
+		keyKey string
+		codecs []string
+	}{
+		{name: "cert and key in one field", record: map[string]string{"cert": bundle}},
+		{name: "key in keyKey", record: map[string]string{"cert": string(certDER), "key": string(keyDER)}, keyKey: "key"},
+		{name: "gzip detected", record: map[string]string{"cert": gzipped.String()}},
+		{name: "base64 codec", record: map[string]string{"cert": base64.StdEncoding.EncodeToString([]byte(bundle))}, codecs: []string{"base64"}},
+		{name: "gzip codec", record: map[string]string{"cert": gzipped.String()}, codecs: []string{"gzip"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcg := newTestCertGetter(t, newFakeRedis(map[string]map[string]string{
+				"certs:example.com": tt.record,
+			}))
+			rcg.Format = formatDER
+			rcg.KeyKey = tt.keyKey
+			codecs, err := newCodecChain(tt.codecs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rcg.codecs = codecs
+
+			cert, err := rcg.GetCertificate(context.Background(), &tls.ClientHelloInfo{ServerName: "example.com"})
+			if err != nil {
+				t.Fatalf("GetCertificate() error = %v", err)
+			}
+			if cert == nil || len(cert.Certificate) != 1 || !bytes.Equal(cert.Certificate[0], certDER) {
+				t.Fatal("GetCertificate() did not serve the stored DER certificate unchanged")
+			}
+			if cert.Leaf == nil || !bytes.Equal(cert.Leaf.Raw, certDER) {
+				t.Error("GetCertificate() leaf differs from the stored certificate")
+			}
+		})
+	}
+}
+
+// staticManager is a certmagic.Manager serving one certificate.
+type staticManager struct {
+	cert  *tls.Certificate
+	calls int
+}
+
+func (m *staticManager) GetCertificate(context.Context, *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.calls++
+	return m.cert, nil
+}
+
+// firstCertificate asks managers in turn as certmagic's Config does: an
+// error is logged and the next manager asked, the first certificate wins.
+func firstCertificate(managers []certmagic.Manager, hello *tls.ClientHelloInfo) (*tls.Certificate, []error) {
+	var errs []error
+	for _, manager := range managers {
+		cert, err := manager.GetCertificate(context.Background(), hello)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if cert != nil {
+			return cert, errs
+		}
+	}
+
+	return nil, errs
+}
+
+func TestGetCertificateManagerChain(t *testing.T) {
+	bundle := testPEMBundle(t, "example.com")
+	errRefused := errors.New("connection refused")
+
+	tests := []struct {
+		name            string
+		record          map[string]string
+		redisErr        error
+		onMiss, onError string
+		wantRedisCert   bool
+		wantErr         error
+		wantNextCalled  bool
+	}{
+		{name: "found", record: map[string]string{"cert": bundle}, wantRedisCert: true},
+		{name: "miss returns error", wantErr: ErrCertNotFound, wantNextCalled: true},
+		{name: "miss declined", onMiss: policyDecline, wantNextCalled: true},
+		{name: "redis error returned", redisErr: errRefused, wantErr: ErrRedisUnavailable, wantNextCalled: true},
+		{name: "redis error declined", redisErr: errRefused, onError: policyDecline, wantNextCalled: true},
+		{name: "broken record returned", record: map[string]string{"cert": "garbage"}, wantErr: ErrInvalidRecord, wantNextCalled: true},
+		{name: "broken record declined", record: map[string]string{"cert": "garbage"}, onError: policyDecline, wantNextCalled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeRedis(map[string]map[string]string{})
+			if tt.record != nil {
+				client.hashes["certs:example.com"] = tt.record
+			}
+			client.err = tt.redisErr
+			rcg := newTestCertGetter(t, client)
+			rcg.OnMiss, rcg.OnError = tt.onMiss, tt.onError
+			certDER, keyDER := testCertificate(t, "example.com")
+			next := &staticManager{cert: &tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: keyDER}}
+
+			cert, errs := firstCertificate([]certmagic.Manager{rcg, next}, &tls.ClientHelloInfo{ServerName: "example.com"})
+
+			if tt.wantRedisCert && (cert == nil || cert == next.cert) {
+				t.Error("certificate from Redis not served")
+			}
+			if !tt.wantRedisCert && cert != next.cert {
+				t.Error("certificate of the next manager not served")
+			}
+			if (next.calls > 0) != tt.wantNextCalled {
+				t.Errorf("next manager called %d times, want called %v", next.calls, tt.wantNextCalled)
+			}
+			switch {
+			case tt.wantErr == nil && len(errs) > 0:
+				t.Errorf("GetCertificate() error = %v, want none", errs[0])
+			case tt.wantErr != nil && (len(errs) != 1 || !errors.Is(errs[0], tt.wantErr)):
+				t.Errorf("GetCertificate() errors = %v, want %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCertGetterSelfTest(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   map[string]string
+		redisErr error
+		wantErr  bool
+	}{
+		{name: "certificate", record: map[string]string{"cert": testPEMBundle(t, "health.example.com")}},
+		{name: "missing record", wantErr: true},
+		{name: "missing field", record: map[string]string{"other": "x"}, wantErr: true},
+		{name: "empty field", record: map[string]string{"cert": ""}, wantErr: true},
+		{name: "not a certificate", record: map[string]string{"cert": "ok"}, wantErr: true},
+		{name: "redis down", redisErr: errors.New("connection refused"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeRedis(map[string]map[string]string{})
+			if tt.record != nil {
+				client.hashes["health:ping"] = tt.record
+			}
+			client.err = tt.redisErr
+			rcg := newTestCertGetter(t, client)
+			rcg.SelfTestKey = "health:ping"
+
+			err := rcg.selfTest(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selfTest() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "health:ping") {
+				t.Errorf("selfTest() error %q doesn't name the sentinel key", err)
+			}
+		})
+	}
+}
+
+func TestGetCertificateCanceled(t *testing.T) {
+	client := newFakeRedis(map[string]map[string]string{})
+	client.block = true
+	rcg := newTestCertGetter(t, client)
+	// neither applies to a handshake that went away
+	rcg.OnError = policyDecline
+	rcg.breaker = newCircuitBreaker(1, 0, rcg.logger)
+	redisErrors := dynamicRoutingMetrics.errors.WithLabelValues(metricsModuleTLS, errorTypeRedis)
+	before := testutil.ToFloat64(redisErrors)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	cert, err := rcg.GetCertificate(ctx, &tls.ClientHelloInfo{ServerName: "example.com"})
+
+	if cert != nil || !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetCertificate() = %v, %v, want context.Canceled", cert, err)
+	}
+	if errors.Is(err, ErrRedisUnavailable) {
+		t.Error("canceled lookup reported as Redis unavailable")
+	}
+	if rcg.breaker.isOpen() {
+		t.Error("canceled lookup opened the circuit breaker")
+	}
+	if got := testutil.ToFloat64(redisErrors); got != before {
+		t.Errorf("redis errors counted = %v, want %v", got-before, 0)
+	}
+}
+
+// handshakeKey marks contexts derived from a handshake's.
+type handshakeKey struct{}
+
+func TestGetCertificateLookupContext(t *testing.T) {
+	client := newFakeRedis(map[string]map[string]string{
+		"certs:example.com": {"cert": testPEMBundle(t, "example.com")},
+	})
+	rcg := newTestCertGetter(t, client)
+	rcg.HandshakeTimeout = caddy.Duration(time.Second)
+
+	ctx := context.WithValue(context.Background(), handshakeKey{}, true)
+	if _, err := rcg.GetCertificate(ctx, &tls.ClientHelloInfo{ServerName: "example.com"}); err != nil {
+		t.Fatalf("GetCertificate() error = %v", err)
+	}
+
+	ctxs := client.contexts()
+	if len(ctxs) != 1 || ctxs[0].Value(handshakeKey{}) == nil {
+		t.Error("lookup not bound to the handshake context")
+	}
+}
+
+func TestCertGetterDecodeLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxCertSize int
+		compression string
+		codecs      []string
+		size        int
+		wantErr     error
+	}{
+		{name: "detected", size: 1024},
+		{name: "detected over max_cert_size", maxCertSize: 1000, size: 1001, wantErr: errCertTooLarge},
+		{name: "compression gzip over max_cert_size", maxCertSize: 1000, compression: compressionGzip, size: 1001, wantErr: errCertTooLarge},
+		{name: "gzip codec over max_cert_size", maxCertSize: 1000, codecs: []string{"gzip"}, size: 1001, wantErr: errCertTooLarge},
+		{name: "no limit", maxCertSize: -1, size: 2 << 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcg := newTestCertGetter(t, newFakeRedis(nil))
+			rcg.MaxCertSize, rcg.Compression = tt.maxCertSize, tt.compression
+			codecs, err := newCodecChain(tt.codecs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rcg.codecs = codecs
+
+			decoded, err := rcg.decode("cert", gzipped(t, tt.size))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("decode() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || len(decoded) != tt.size {
+				t.Errorf("decode() = %d bytes, %v, want %d bytes", len(decoded), err, tt.size)
+			}
+		})
+	}
+}
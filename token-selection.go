@@ -0,0 +1,74 @@
+package guard
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// Values of TokenSource.
+const (
+	tokenSourceHash = "hash"
+	tokenSourceList = "list"
+	tokenSourceSet  = "set"
+)
+
+// tokenSeparator joins the members of a list or set in the cached record.
+// Tokens end up in host names, so they never contain it.
+const tokenSeparator = "\n"
+
+// maxTokenRotations bounds the hosts tracked by tokenRotation.
+const maxTokenRotations = 10000
+
+// joinTokens returns the non-empty members as one record value, or false
+// when there are none.
+func joinTokens(members []string) (string, bool) {
+	tokens := members[:0:0]
+	for _, member := range members {
+		if member != "" {
+			tokens = append(tokens, member)
+		}
+	}
+
+	return strings.Join(tokens, tokenSeparator), len(tokens) > 0
+}
+
+// tokenRotation hands out the tokens of each host's list in turn.
+type tokenRotation struct {
+	mu   sync.Mutex
+	next map[string]int
+}
+
+func newTokenRotation() *tokenRotation {
+	return &tokenRotation{next: make(map[string]int)}
+}
+
+// pick returns the next of tokens for host. Once too many hosts are
+// tracked they all start over, which only skews the order briefly.
+func (t *tokenRotation) pick(host string, tokens []string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i, ok := t.next[host]
+	if !ok && len(t.next) >= maxTokenRotations {
+		t.next = make(map[string]int)
+	}
+	t.next[host] = (i + 1) % len(tokens)
+
+	return tokens[i%len(tokens)]
+}
+
+// selectToken picks one of the joined tokens of a list or set record: in
+// turn for a list, so repeating a token weights it, and at random for a
+// set. Hash records hold a single token, returned as is.
+func (m Middleware) selectToken(host, joined string) string {
+	tokens := strings.Split(joined, tokenSeparator)
+	switch {
+	case len(tokens) == 1:
+		return joined
+	case m.TokenSource == tokenSourceList:
+		return m.rotation.pick(host, tokens)
+	default:
+		return tokens[rand.Intn(len(tokens))]
+	}
+}